@@ -0,0 +1,64 @@
+/*
+ * NTT Security Holdings Go Library for Samurai
+ * Copyright 2023 NTT Security Holdings
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/SamuraiMDR/samurai-go/pkg/transmitter"
+)
+
+// runCleanup implements the "cleanup" command:
+//
+//	cleanup [-older-than DURATION] [-list]
+func runCleanup(client transmitter.Client, args []string) error {
+	flags := flag.NewFlagSet("cleanup", flag.ContinueOnError)
+	olderThan := flags.Duration("older-than", 24*time.Hour, "abort uploads without progress for longer than this")
+	list := flags.Bool("list", false, "only list pending and queued uploads")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *list {
+		pending, err := client.PendingUploads()
+		if err != nil {
+			return err
+		}
+		for _, p := range pending {
+			fmt.Printf("%s  pending  %s  %s  (%s pid %d)\n", p.Started.Format(time.RFC3339), p.Key, p.SourceFilename, p.Hostname, p.PID)
+		}
+		queued, err := client.QueuedUploads()
+		if err != nil {
+			return err
+		}
+		for _, q := range queued {
+			fmt.Printf("%s  queued   %s  %s\n", q.Queued.Format(time.RFC3339), q.FileDetails.PayloadType, q.FileDetails.SourceFilename)
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	aborted, err := client.CleanupStale(ctx, *olderThan)
+	for _, p := range aborted {
+		fmt.Printf("aborted %s (%s, started %s)\n", p.Key, p.SourceFilename, p.Started.Format(time.RFC3339))
+	}
+	return err
+}
@@ -0,0 +1,159 @@
+/*
+ * NTT Security Holdings Go Library for Samurai
+ * Copyright 2023 NTT Security Holdings
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/SamuraiMDR/samurai-go/examples/transmitter/config"
+	"github.com/SamuraiMDR/samurai-go/pkg/credentials"
+	"gopkg.in/yaml.v2"
+)
+
+// passphraseEnv holds the passphrase for encrypted credentials files when no
+// key file is given.
+const passphraseEnv = "SAMURAI_CREDENTIALS_PASSPHRASE"
+
+func encryptionKey(keyFile string) (credentials.EncryptionKey, error) {
+	if keyFile != "" {
+		return credentials.EncryptionKey{KeyFile: keyFile}, nil
+	}
+	passphrase := os.Getenv(passphraseEnv)
+	if passphrase == "" {
+		return credentials.EncryptionKey{}, fmt.Errorf("set -key-file or %s", passphraseEnv)
+	}
+	return credentials.EncryptionKey{Passphrase: passphrase}, nil
+}
+
+// runCredentials implements the "credentials" subcommand:
+//
+//	credentials genkey  -out FILE
+//	credentials encrypt -in credentials.yaml -out credentials.enc [-key-file FILE]
+//	credentials decrypt -in credentials.enc [-out FILE] [-key-file FILE]
+//	credentials edit    -in credentials.enc [-key-file FILE]
+func runCredentials(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: credentials genkey|encrypt|decrypt|edit [flags]")
+	}
+	flags := flag.NewFlagSet("credentials "+args[0], flag.ContinueOnError)
+	in := flags.String("in", "", "input file")
+	out := flags.String("out", "", "output file")
+	keyFile := flags.String("key-file", "", "key file, "+passphraseEnv+" is used when unset")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	if args[0] == "genkey" {
+		if *out == "" {
+			return fmt.Errorf("-out is required")
+		}
+		return credentials.GenerateKeyFile(*out)
+	}
+
+	if *in == "" {
+		return fmt.Errorf("-in is required")
+	}
+	key, err := encryptionKey(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "encrypt":
+		if *out == "" {
+			return fmt.Errorf("-out is required")
+		}
+		cred, err := config.NewTransmitterCredentials(*in)
+		if err != nil {
+			return err
+		}
+		return writeEncrypted(*out, cred, key)
+	case "decrypt":
+		cred, err := credentials.EncryptedFileProvider{Path: *in, Key: key}.Retrieve(context.Background())
+		if err != nil {
+			return err
+		}
+		data, err := yaml.Marshal(cred)
+		if err != nil {
+			return err
+		}
+		if *out == "" {
+			_, err = os.Stdout.Write(data)
+			return err
+		}
+		return os.WriteFile(filepath.Clean(*out), data, 0600)
+	case "edit":
+		return editEncrypted(*in, key)
+	default:
+		return fmt.Errorf("unknown credentials command %q", args[0])
+	}
+}
+
+func writeEncrypted(path string, cred credentials.APICredentials, key credentials.EncryptionKey) error {
+	data, err := credentials.Encrypt(cred, key)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(filepath.Clean(tmp), data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// editEncrypted decrypts the file into a private temporary file, opens it in
+// $EDITOR and encrypts the result again once it validates.
+func editEncrypted(path string, key credentials.EncryptionKey) error {
+	cred, err := credentials.EncryptedFileProvider{Path: path, Key: key}.Retrieve(context.Background())
+	if err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(cred)
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "samurai-credentials")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	plain := filepath.Join(dir, "credentials.yaml")
+	if err := os.WriteFile(plain, data, 0600); err != nil {
+		return err
+	}
+
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	cmd := exec.Command(editor, plain)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+
+	cred, err = config.NewTransmitterCredentials(plain)
+	if err != nil {
+		return fmt.Errorf("edited credentials not saved: %v", err)
+	}
+	return writeEncrypted(path, cred, key)
+}
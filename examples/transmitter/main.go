@@ -17,9 +17,15 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/SamuraiMDR/samurai-go/examples/transmitter/config"
+	"github.com/SamuraiMDR/samurai-go/pkg/credentials"
 	"github.com/SamuraiMDR/samurai-go/pkg/transmitter"
 	log "github.com/sirupsen/logrus"
 )
@@ -28,6 +34,19 @@ func main() {
 	var filename string
 	var payloadType string
 	var destinationFilename string
+	var provider credentials.Provider
+
+	dryRun := flag.Bool("dry-run", false, "validate and print the planned upload without transferring data")
+	dryRunToken := flag.Bool("dry-run-token", false, "with -dry-run, also check the token request against the service")
+	flag.Parse()
+	args := flag.Args()
+
+	if len(args) > 0 && args[0] == "credentials" {
+		if err := runCredentials(args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	configFile := "config.yaml"
 	settings, err := config.NewTransmitterSettings(configFile)
@@ -40,34 +59,97 @@ func main() {
 	} else {
 		log.SetLevel(log.InfoLevel)
 	}
+	settings.DryRun = settings.DryRun || *dryRun
+	settings.DryRunRequestToken = settings.DryRunRequestToken || *dryRunToken
 	credFile := "credentials.yaml"
-	creds, err := config.NewTransmitterCredentials(credFile)
+	encryptedCredFile := "credentials.enc"
+	if _, err := os.Stat(encryptedCredFile); err == nil {
+		key, err := encryptionKey(os.Getenv("SAMURAI_CREDENTIALS_KEY_FILE"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		provider = credentials.EncryptedFileProvider{Path: encryptedCredFile, Key: key}
+	} else {
+		creds, err := config.NewTransmitterCredentials(credFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		provider = creds
+	}
+	client, err := transmitter.NewClient(settings, provider)
 	if err != nil {
 		log.Fatal(err)
 	}
-	if len(os.Args) == 3 {
-		filename = os.Args[1]
-		payloadType = os.Args[2]
+
+	if len(args) == 1 && args[0] == "verify" {
+		if err := runVerify(client); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if len(args) > 0 && args[0] == "cleanup" {
+		if err := runCleanup(client, args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// audit [SEQ HASH] verifies the chain, from the given last archived entry
+	// if the oldest audit files were removed.
+	if len(args) > 0 && args[0] == "audit" && (len(args) == 1 || len(args) == 3) {
+		if settings.AuditLog == "" {
+			log.Fatal("no audit_log configured")
+		}
+		var anchor transmitter.AuditAnchor
+		if len(args) == 3 {
+			seq, err := strconv.ParseInt(args[1], 10, 64)
+			if err != nil {
+				log.Fatalf("invalid audit anchor sequence %q", args[1])
+			}
+			anchor = transmitter.AuditAnchor{Seq: seq, Hash: args[2]}
+		}
+		n, err := transmitter.VerifyAuditLogFrom(settings.AuditLog, anchor)
 		if err != nil {
-			panic(err)
+			log.Fatal(err)
+		}
+		fmt.Printf("audit log %s: %d entries verified\n", settings.AuditLog, n)
+		return
+	}
+
+	if len(args) == 1 && args[0] == "sweep" {
+		removed, err := client.SweepArchive()
+		for _, path := range removed {
+			fmt.Println(path)
 		}
-	} else if len(os.Args) == 4 {
-		filename = os.Args[1]
-		payloadType = os.Args[2]
-		destinationFilename = os.Args[3]
 		if err != nil {
-			panic(err)
+			log.Fatal(err)
 		}
-	} else {
-		log.Fatalln("filename or payload argument is missing")
+		return
 	}
 
-	client, err := transmitter.NewClient(settings, creds)
-	if err != nil {
-		log.Fatal(err)
+	if len(args) == 1 && args[0] == "resend" {
+		if err := client.SendQueued(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	err = client.SendFile(transmitter.FileDetails{
+	if len(args) == 2 {
+		filename = args[0]
+		payloadType = args[1]
+	} else if len(args) == 3 {
+		filename = args[0]
+		payloadType = args[1]
+		destinationFilename = args[2]
+	} else {
+		log.Fatalln("filename or payload argument is missing")
+	}
+
+	// On SIGINT or SIGTERM, give the upload 30 seconds to finish. signalled
+	// only gates new uploads, the upload itself must not use it.
+	signalled, wait := client.ShutdownOnSignal(context.Background(), 30*time.Second)
+	upload, err := client.SendFileContext(context.Background(), transmitter.FileDetails{
 		SourceFilename:      filename,
 		DestinationFilename: destinationFilename,
 		PayloadType:         payloadType,
@@ -76,7 +158,19 @@ func main() {
 		// CustomKey:   "source",
 		// CustomValue: "example",
 	})
+	if signalled.Err() != nil {
+		if shutdownErr := wait(); shutdownErr != nil {
+			log.Error(shutdownErr)
+		}
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
+	if upload.DispositionError != nil {
+		log.Warn(upload.DispositionError)
+	}
+	if upload.DryRun {
+		fmt.Printf("dry run: %s as %s %q (.%s), %d bytes in %d parts of %d bytes, sha256 %s, backend %q\n",
+			upload.SourceFilename, upload.PayloadType, upload.DestinationFilename, upload.Suffix, upload.Size, upload.Parts, upload.PartSize, upload.SHA256, upload.Backend)
+	}
 }
@@ -0,0 +1,46 @@
+/*
+ * NTT Security Holdings Go Library for Samurai
+ * Copyright 2023 NTT Security Holdings
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/SamuraiMDR/samurai-go/pkg/transmitter"
+)
+
+// runVerify implements the "verify" command, printing one line per check.
+func runVerify(client transmitter.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	report, err := client.Verify(ctx)
+	for _, step := range report.Steps {
+		status := "ok"
+		if step.Skipped {
+			status = "skipped"
+		} else if !step.OK {
+			status = "FAILED"
+		}
+		fmt.Printf("%-15s %-8s %s\n", step.Name, status, step.Reason)
+	}
+	if err != nil {
+		return err
+	}
+	return report.Err()
+}
@@ -7,8 +7,12 @@ toolchain go1.24.6
 require (
 	github.com/Azure/azure-sdk-for-go/sdk/azcore v1.19.1
 	github.com/Azure/azure-sdk-for-go/sdk/storage/azblob v1.6.3
+	github.com/google/uuid v1.6.0
 	github.com/inhies/go-bytesize v0.0.0-20220417184213-4913239db9cf
 	github.com/sirupsen/logrus v1.9.3
+	golang.org/x/crypto v0.43.0
+	golang.org/x/sync v0.17.0
+	gopkg.in/yaml.v2 v2.4.0
 )
 
 require (
@@ -0,0 +1,281 @@
+/*
+ * NTT Security Holdings Go Library for Samurai
+ * Copyright 2023 NTT Security Holdings
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package credentials
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+	"gopkg.in/yaml.v2"
+)
+
+// ErrDecrypt is returned when an encrypted credentials file cannot be
+// opened, either because the key is wrong or the file has been modified.
+var ErrDecrypt = errors.New("could not decrypt credentials, wrong key or corrupted file")
+
+const (
+	encryptedVersion = 1
+	kdfScrypt        = "scrypt"
+	kdfKeyFile       = "keyfile"
+	scryptN          = 1 << 15
+	scryptR          = 8
+	scryptP          = 1
+	keyLength        = 32
+
+	// Upper bounds for scrypt parameters read from a file, so that a crafted
+	// file cannot make the key derivation use more than 256MB or run for
+	// minutes.
+	maxScryptN      = 1 << 20
+	maxScryptR      = 32
+	maxScryptP      = 16
+	maxScryptMemory = 256 << 20
+)
+
+// EncryptionKey selects how the key for an encrypted credentials file is
+// obtained. Exactly one of Passphrase and KeyFile must be set. A key file
+// holds 32 random bytes, either raw or hex encoded.
+type EncryptionKey struct {
+	Passphrase string
+	KeyFile    string
+}
+
+// encryptedFile is the on-disk format. The plaintext is the YAML encoding of
+// APICredentials, sealed with AES-256-GCM.
+type encryptedFile struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	Salt       []byte `json:"salt,omitempty"`
+	N          int    `json:"n,omitempty"`
+	R          int    `json:"r,omitempty"`
+	P          int    `json:"p,omitempty"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// additionalData binds the header fields to the ciphertext so they cannot
+// be altered without failing authentication.
+func (f encryptedFile) additionalData() []byte {
+	return []byte(fmt.Sprintf("samurai-credentials/v%d/%s/%d/%d/%d", f.Version, f.KDF, f.N, f.R, f.P))
+}
+
+func (k EncryptionKey) derive(f *encryptedFile) ([]byte, error) {
+	switch {
+	case k.Passphrase != "" && k.KeyFile != "":
+		return nil, fmt.Errorf("only one of passphrase or key file can be used")
+	case k.Passphrase != "":
+		if f.KDF != kdfScrypt {
+			return nil, fmt.Errorf("credentials file is not passphrase protected")
+		}
+		if err := checkScryptParams(f.N, f.R, f.P); err != nil {
+			return nil, err
+		}
+		return deriveKey([]byte(k.Passphrase), f.Salt, f.N, f.R, f.P, keyLength)
+	case k.KeyFile != "":
+		if f.KDF != kdfKeyFile {
+			return nil, fmt.Errorf("credentials file is not key file protected")
+		}
+		return readKeyFile(k.KeyFile)
+	default:
+		return nil, fmt.Errorf("passphrase or key file is required")
+	}
+}
+
+// deriveKey is scrypt.Key, replaced in tests.
+var deriveKey = scrypt.Key
+
+// checkScryptParams rejects scrypt parameters that are invalid or exceed the
+// bounds above. scrypt needs 128*N*R bytes of memory.
+func checkScryptParams(n, r, p int) error {
+	if n <= 1 || n&(n-1) != 0 || n > maxScryptN || r < 1 || r > maxScryptR || p < 1 || p > maxScryptP || 128*n*r > maxScryptMemory {
+		return fmt.Errorf("unsupported scrypt parameters n=%d r=%d p=%d: %w", n, r, p, ErrDecrypt)
+	}
+	return nil
+}
+
+func readKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == keyLength {
+		return data, nil
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != keyLength {
+		return nil, fmt.Errorf("key file %s must hold %d raw or hex encoded bytes", path, keyLength)
+	}
+	return key, nil
+}
+
+// GenerateKeyFile writes a new random hex encoded key to path. It refuses to
+// overwrite an existing file.
+func GenerateKeyFile(path string) error {
+	key := make([]byte, keyLength)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filepath.Clean(path), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(hex.EncodeToString(key) + "\n"); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Encrypt seals the credentials with the given key and returns the content
+// of an encrypted credentials file.
+func Encrypt(cred APICredentials, key EncryptionKey) ([]byte, error) {
+	f := encryptedFile{Version: encryptedVersion, KDF: kdfKeyFile}
+	if key.Passphrase != "" {
+		f.KDF = kdfScrypt
+		f.N, f.R, f.P = scryptN, scryptR, scryptP
+		f.Salt = make([]byte, 16)
+		if _, err := rand.Read(f.Salt); err != nil {
+			return nil, err
+		}
+	}
+	derived, err := key.derive(&f)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(derived)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := yaml.Marshal(cred)
+	if err != nil {
+		return nil, err
+	}
+	f.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(f.Nonce); err != nil {
+		return nil, err
+	}
+	f.Ciphertext = gcm.Seal(nil, f.Nonce, plaintext, f.additionalData())
+	return json.MarshalIndent(f, "", "  ")
+}
+
+// Decrypt opens the content of an encrypted credentials file.
+func Decrypt(data []byte, key EncryptionKey) (APICredentials, error) {
+	var f encryptedFile
+	var cred APICredentials
+
+	if err := json.Unmarshal(data, &f); err != nil {
+		return cred, fmt.Errorf("not an encrypted credentials file: %v", err)
+	}
+	if f.Version != encryptedVersion {
+		return cred, fmt.Errorf("unsupported encrypted credentials version %d", f.Version)
+	}
+	derived, err := key.derive(&f)
+	if err != nil {
+		return cred, err
+	}
+	gcm, err := newGCM(derived)
+	if err != nil {
+		return cred, err
+	}
+	if len(f.Nonce) != gcm.NonceSize() {
+		return cred, ErrDecrypt
+	}
+	plaintext, err := gcm.Open(nil, f.Nonce, f.Ciphertext, f.additionalData())
+	if err != nil {
+		return cred, ErrDecrypt
+	}
+	if err := yaml.Unmarshal(plaintext, &cred); err != nil {
+		return APICredentials{}, err
+	}
+	return cred, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptedFileProvider reads credentials from a file written by Encrypt.
+// The decrypted credentials are cached until the file or the key changes, so
+// the key derivation does not run for every upload.
+type EncryptedFileProvider struct {
+	Path string
+	Key  EncryptionKey
+}
+
+// decryptedEntry is the last decrypted content of an encrypted file.
+type decryptedEntry struct {
+	digest [sha256.Size]byte
+	cred   APICredentials
+}
+
+// decryptedFiles maps the path of an encrypted file to its decryptedEntry.
+var decryptedFiles sync.Map
+
+func (p EncryptedFileProvider) Retrieve(ctx context.Context) (APICredentials, error) {
+	data, err := os.ReadFile(filepath.Clean(p.Path))
+	if errors.Is(err, os.ErrNotExist) {
+		return APICredentials{}, fmt.Errorf("file %s: %w", p.Path, ErrNoCredentials)
+	}
+	if err != nil {
+		return APICredentials{}, err
+	}
+	// The digest covers the key too, a different key must not get the
+	// credentials decrypted with the right one.
+	hasher := sha256.New()
+	for _, part := range []string{string(data), p.Key.Passphrase, p.Key.KeyFile} {
+		hasher.Write([]byte(part))
+		hasher.Write([]byte{0})
+	}
+	if p.Key.KeyFile != "" {
+		key, err := os.ReadFile(filepath.Clean(p.Key.KeyFile))
+		if err != nil {
+			return APICredentials{}, err
+		}
+		hasher.Write(key)
+	}
+	var digest [sha256.Size]byte
+	hasher.Sum(digest[:0])
+	if entry, ok := decryptedFiles.Load(p.Path); ok && entry.(decryptedEntry).digest == digest {
+		cred := entry.(decryptedEntry).cred
+		cred.ExtraHeaders = maps.Clone(cred.ExtraHeaders)
+		return cred, nil
+	}
+	cred, err := Decrypt(data, p.Key)
+	if err != nil {
+		return cred, err
+	}
+	cached := cred
+	cached.ExtraHeaders = maps.Clone(cred.ExtraHeaders)
+	decryptedFiles.Store(p.Path, decryptedEntry{digest: digest, cred: cached})
+	return cred, nil
+}
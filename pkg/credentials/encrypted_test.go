@@ -0,0 +1,132 @@
+package credentials
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	cred := APICredentials{URL: "https://host", APIKey: "key", Passkey: "secret-passkey", DeviceId: "device"}
+	keyFile := filepath.Join(t.TempDir(), "credentials.key")
+	if err := GenerateKeyFile(keyFile); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []EncryptionKey{{Passphrase: "correct horse"}, {KeyFile: keyFile}} {
+		data, err := Encrypt(cred, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), cred.Passkey) || strings.Contains(string(data), cred.APIKey+"\n") {
+			t.Fatalf("plaintext secret found in encrypted file: %s", data)
+		}
+		got, err := Decrypt(data, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Passkey != cred.Passkey || got.DeviceId != cred.DeviceId {
+			t.Fatalf("unexpected credentials: %+v", got)
+		}
+	}
+}
+
+func TestDecryptWrongKey(t *testing.T) {
+	data, err := Encrypt(APICredentials{URL: "https://host"}, EncryptionKey{Passphrase: "right"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decrypt(data, EncryptionKey{Passphrase: "wrong"}); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("expected ErrDecrypt, got %v", err)
+	}
+	if _, err := Decrypt(data, EncryptionKey{KeyFile: "unused"}); err == nil {
+		t.Fatal("expected error when using a key file on a passphrase file")
+	}
+}
+
+func TestEncryptedFileProvider(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials.enc")
+	key := EncryptionKey{Passphrase: "pass"}
+	data, err := Encrypt(APICredentials{URL: "https://host", APIKey: "key"}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	derivations := 0
+	deriveKey = func(password, salt []byte, n, r, p, keyLen int) ([]byte, error) {
+		derivations++
+		return scrypt.Key(password, salt, n, r, p, keyLen)
+	}
+	t.Cleanup(func() { deriveKey = scrypt.Key })
+
+	provider := EncryptedFileProvider{Path: path, Key: key}
+	for i := 0; i < 3; i++ {
+		cred, err := provider.Retrieve(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cred.APIKey != "key" {
+			t.Fatalf("unexpected credentials: %+v", cred)
+		}
+	}
+	if derivations != 1 {
+		t.Fatalf("expected one key derivation for an unchanged file, got %d", derivations)
+	}
+
+	// A changed file and a wrong key are not served from the cache.
+	data, err = Encrypt(APICredentials{URL: "https://host", APIKey: "rotated"}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if cred, err := provider.Retrieve(context.Background()); err != nil || cred.APIKey != "rotated" {
+		t.Fatalf("expected rotated credentials, got %+v, %v", cred, err)
+	}
+	if _, err := (EncryptedFileProvider{Path: path, Key: EncryptionKey{Passphrase: "wrong"}}).Retrieve(context.Background()); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("expected ErrDecrypt, got %v", err)
+	}
+}
+
+func TestDecryptRejectsExpensiveScrypt(t *testing.T) {
+	key := EncryptionKey{Passphrase: "pass"}
+	data, err := Encrypt(APICredentials{URL: "https://host"}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name    string
+		n, r, p int
+	}{
+		{"huge n", 1 << 30, 8, 1},
+		{"huge r", 1 << 15, 1 << 20, 1},
+		{"huge p", 1 << 15, 8, 1 << 20},
+		{"memory", 1 << 20, 32, 1},
+		{"not a power of two", 1000, 8, 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var f map[string]interface{}
+			if err := json.Unmarshal(data, &f); err != nil {
+				t.Fatal(err)
+			}
+			f["n"], f["r"], f["p"] = c.n, c.r, c.p
+			crafted, err := json.Marshal(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Decrypt(crafted, key); !errors.Is(err, ErrDecrypt) || !strings.Contains(err.Error(), "scrypt") {
+				t.Fatalf("expected rejected scrypt parameters, got %v", err)
+			}
+		})
+	}
+}
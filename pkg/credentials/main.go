@@ -16,11 +16,97 @@
  */
 package credentials
 
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// APICredentials authenticate against the payload API. Formatting them
+// with fmt, logrus' text formatter or slog hides the secrets, while JSON
+// and YAML encoding keep them so that credentials can be written back. Log
+// them as JSON through Redacted or RedactHook.
 type APICredentials struct {
-	URL           string            `yaml:"url"`
-	APIKey        string            `yaml:"apiKey"`
-	Passkey       string            `yaml:"passkey"`
-	DeviceId      string            `yaml:"deviceId"`
-	IntegrationId string            `yaml:"integrationId"`
-	ExtraHeaders  map[string]string `yaml:"extraHeaders,omitempty"`
+	URL           string            `yaml:"url" json:"url"`
+	APIKey        string            `yaml:"apiKey" json:"apiKey"`
+	Passkey       string            `yaml:"passkey" json:"passkey"`
+	DeviceId      string            `yaml:"deviceId" json:"deviceId"`
+	IntegrationId string            `yaml:"integrationId" json:"integrationId"`
+	ExtraHeaders  map[string]string `yaml:"extraHeaders,omitempty" json:"extraHeaders,omitempty"`
+	// AllowHTTP permits a plain http URL, for testing against local services.
+	AllowHTTP bool `yaml:"allowHttp,omitempty" json:"allowHttp,omitempty"`
+}
+
+// Retrieve returns the credentials unchanged, which lets a static
+// APICredentials value be used wherever a Provider is expected.
+func (c APICredentials) Retrieve(ctx context.Context) (APICredentials, error) {
+	return c, nil
+}
+
+// authHeaders are set by the transmitter itself and cannot be overridden
+// through ExtraHeaders.
+var authHeaders = map[string]bool{
+	"x-api-key":      true,
+	"passkey":        true,
+	"device_id":      true,
+	"deviceid":       true,
+	"integration_id": true,
+	"integrationid":  true,
+}
+
+// Validate checks that the credentials are complete and usable: URL, APIKey
+// and Passkey are set, exactly one of DeviceId and IntegrationId is set, the
+// URL is an https base URL (http only with AllowHTTP) and ExtraHeaders do not
+// replace any of the authentication headers.
+func (c APICredentials) Validate() error {
+	checks := []struct {
+		bad    bool
+		errMsg string
+	}{
+		{c.URL == "", "URL not defined"},
+		{c.APIKey == "", "apiKey is undefined"},
+		{c.Passkey == "", "passkey is undefined"},
+		{c.DeviceId == "" && c.IntegrationId == "", "deviceId or integrationId needs to be defined"},
+		{c.DeviceId != "" && c.IntegrationId != "", "only one of deviceId or integrationId can be defined"},
+	}
+
+	for _, check := range checks {
+		if check.bad {
+			return fmt.Errorf("invalid credentials: %s", check.errMsg)
+		}
+	}
+
+	if err := c.validateURL(); err != nil {
+		return fmt.Errorf("invalid credentials: %v", err)
+	}
+
+	for key := range c.ExtraHeaders {
+		if authHeaders[strings.ToLower(key)] {
+			return fmt.Errorf("invalid credentials: extra header %q would override authentication", key)
+		}
+	}
+	return nil
+}
+
+func (c APICredentials) validateURL() error {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("URL %q cannot be parsed: %v", redactedURL(c.URL), err)
+	}
+	switch {
+	case u.Scheme == "http" && !c.AllowHTTP:
+		return fmt.Errorf("URL %q must use https, set allowHttp to permit http", u.Redacted())
+	case u.Scheme != "https" && u.Scheme != "http":
+		return fmt.Errorf("URL %q must use https", u.Redacted())
+	case u.Host == "":
+		return fmt.Errorf("URL %q has no host", u.Redacted())
+	case u.RawQuery != "" || u.Fragment != "":
+		return fmt.Errorf("URL %q must not have a query or fragment", u.Redacted())
+	case strings.HasSuffix(u.Path, "/"):
+		return fmt.Errorf("URL %q must not end with a slash", u.Redacted())
+	case strings.Contains(u.Path, "/cts/payload"):
+		return fmt.Errorf("URL %q must be the base URL, without /cts/payload", u.Redacted())
+	}
+	return nil
 }
@@ -0,0 +1,43 @@
+package credentials
+
+import "testing"
+
+func TestValidate(t *testing.T) {
+	valid := func() APICredentials {
+		return APICredentials{URL: "https://host", APIKey: "key", Passkey: "pass", DeviceId: "device"}
+	}
+	cases := []struct {
+		name    string
+		modify  func(c *APICredentials)
+		wantErr bool
+	}{
+		{"valid", func(c *APICredentials) {}, false},
+		{"valid with port and prefix", func(c *APICredentials) { c.URL = "https://host:8443/api" }, false},
+		{"integration id", func(c *APICredentials) { c.DeviceId, c.IntegrationId = "", "integration" }, false},
+		{"missing url", func(c *APICredentials) { c.URL = "" }, true},
+		{"missing api key", func(c *APICredentials) { c.APIKey = "" }, true},
+		{"missing passkey", func(c *APICredentials) { c.Passkey = "" }, true},
+		{"missing ids", func(c *APICredentials) { c.DeviceId = "" }, true},
+		{"both ids", func(c *APICredentials) { c.IntegrationId = "integration" }, true},
+		{"http", func(c *APICredentials) { c.URL = "http://host" }, true},
+		{"http allowed", func(c *APICredentials) { c.URL, c.AllowHTTP = "http://host", true }, false},
+		{"other scheme", func(c *APICredentials) { c.URL = "ftp://host" }, true},
+		{"no scheme", func(c *APICredentials) { c.URL = "host" }, true},
+		{"trailing slash", func(c *APICredentials) { c.URL = "https://host/" }, true},
+		{"payload path", func(c *APICredentials) { c.URL = "https://host/cts/payload" }, true},
+		{"query", func(c *APICredentials) { c.URL = "https://host?x=1" }, true},
+		{"extra header", func(c *APICredentials) { c.ExtraHeaders = map[string]string{"x-proxy": "1"} }, false},
+		{"api key header", func(c *APICredentials) { c.ExtraHeaders = map[string]string{"X-Api-Key": "other"} }, true},
+		{"passkey header", func(c *APICredentials) { c.ExtraHeaders = map[string]string{"passkey": "other"} }, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cred := valid()
+			c.modify(&cred)
+			err := cred.Validate()
+			if (err != nil) != c.wantErr {
+				t.Fatalf("Validate() error = %v, wantErr = %v", err, c.wantErr)
+			}
+		})
+	}
+}
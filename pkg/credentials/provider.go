@@ -0,0 +1,198 @@
+/*
+ * NTT Security Holdings Go Library for Samurai
+ * Copyright 2023 NTT Security Holdings
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package credentials
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ErrNoCredentials is returned by a provider when its source holds no
+// credentials at all, as opposed to holding credentials that cannot be read.
+var ErrNoCredentials = errors.New("no credentials found")
+
+// Provider supplies API credentials on demand. Retrieve is called for every
+// upload, so implementations should be cheap or cache internally.
+type Provider interface {
+	Retrieve(ctx context.Context) (APICredentials, error)
+}
+
+// EnvProvider reads credentials from environment variables named Prefix
+// followed by URL, API_KEY, PASSKEY, DEVICE_ID, INTEGRATION_ID and
+// EXTRA_HEADERS. EXTRA_HEADERS is a comma separated list of name=value pairs.
+// An empty Prefix defaults to "SAMURAI_".
+type EnvProvider struct {
+	Prefix string
+}
+
+func (p EnvProvider) Retrieve(ctx context.Context) (APICredentials, error) {
+	prefix := p.Prefix
+	if prefix == "" {
+		prefix = "SAMURAI_"
+	}
+	cred := APICredentials{
+		URL:           os.Getenv(prefix + "URL"),
+		APIKey:        os.Getenv(prefix + "API_KEY"),
+		Passkey:       os.Getenv(prefix + "PASSKEY"),
+		DeviceId:      os.Getenv(prefix + "DEVICE_ID"),
+		IntegrationId: os.Getenv(prefix + "INTEGRATION_ID"),
+	}
+	if headers := os.Getenv(prefix + "EXTRA_HEADERS"); headers != "" {
+		var err error
+		if cred.ExtraHeaders, err = parseHeaders(headers, prefix+"EXTRA_HEADERS"); err != nil {
+			return APICredentials{}, err
+		}
+	}
+	if cred.URL == "" && cred.APIKey == "" && cred.Passkey == "" {
+		return APICredentials{}, fmt.Errorf("environment %s*: %w", prefix, ErrNoCredentials)
+	}
+	return cred, nil
+}
+
+// parseHeaders parses name=value pairs separated by commas or newlines.
+func parseHeaders(text string, source string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, pair := range strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("invalid %s entry %q, expected name=value", source, pair)
+		}
+		headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return headers, nil
+}
+
+// FileProvider reads credentials from a YAML or JSON file. Files ending in
+// .json are decoded as JSON, everything else as YAML.
+type FileProvider struct {
+	Path string
+}
+
+func (p FileProvider) Retrieve(ctx context.Context) (APICredentials, error) {
+	var cred APICredentials
+
+	data, err := os.ReadFile(filepath.Clean(p.Path))
+	if errors.Is(err, os.ErrNotExist) {
+		return cred, fmt.Errorf("file %s: %w", p.Path, ErrNoCredentials)
+	}
+	if err != nil {
+		return cred, err
+	}
+	return p.parse(data)
+}
+
+func (p FileProvider) parse(data []byte) (APICredentials, error) {
+	var cred APICredentials
+	var err error
+
+	if strings.EqualFold(filepath.Ext(p.Path), ".json") {
+		err = json.Unmarshal(data, &cred)
+	} else {
+		err = yaml.Unmarshal(data, &cred)
+	}
+	if err != nil {
+		return APICredentials{}, fmt.Errorf("could not parse credentials file %s: %v", p.Path, err)
+	}
+	return cred, nil
+}
+
+// SecretDirProvider reads credentials from a directory holding one file per
+// field, as produced by mounting a Kubernetes secret. File names match the
+// YAML keys: url, apiKey, passkey, deviceId, integrationId and extraHeaders.
+// extraHeaders holds name=value pairs separated by commas or newlines. Missing
+// files leave the field empty and surrounding whitespace is trimmed.
+type SecretDirProvider struct {
+	Dir string
+}
+
+func (p SecretDirProvider) Retrieve(ctx context.Context) (APICredentials, error) {
+	var cred APICredentials
+
+	if _, err := os.Stat(p.Dir); errors.Is(err, os.ErrNotExist) {
+		return cred, fmt.Errorf("directory %s: %w", p.Dir, ErrNoCredentials)
+	}
+	fields := []struct {
+		name  string
+		value *string
+	}{
+		{"url", &cred.URL},
+		{"apiKey", &cred.APIKey},
+		{"passkey", &cred.Passkey},
+		{"deviceId", &cred.DeviceId},
+		{"integrationId", &cred.IntegrationId},
+	}
+	found := false
+	for _, field := range fields {
+		data, err := os.ReadFile(filepath.Join(p.Dir, field.name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return APICredentials{}, err
+		}
+		*field.value = strings.TrimSpace(string(data))
+		found = true
+	}
+	data, err := os.ReadFile(filepath.Join(p.Dir, "extraHeaders"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return APICredentials{}, err
+	}
+	if err == nil {
+		if cred.ExtraHeaders, err = parseHeaders(string(data), filepath.Join(p.Dir, "extraHeaders")); err != nil {
+			return APICredentials{}, err
+		}
+		found = true
+	}
+	if !found {
+		return APICredentials{}, fmt.Errorf("directory %s: %w", p.Dir, ErrNoCredentials)
+	}
+	return cred, nil
+}
+
+// ChainProvider returns the credentials of the first provider that has
+// any. Providers whose source is empty, reported as ErrNoCredentials, are
+// skipped; any other error, such as a corrupt or unreadable file, is
+// returned at once rather than hidden by a later source.
+type ChainProvider []Provider
+
+func (p ChainProvider) Retrieve(ctx context.Context) (APICredentials, error) {
+	var errs []error
+	for _, provider := range p {
+		cred, err := provider.Retrieve(ctx)
+		if err == nil {
+			return cred, nil
+		}
+		if !errors.Is(err, ErrNoCredentials) {
+			return APICredentials{}, err
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return APICredentials{}, ErrNoCredentials
+	}
+	return APICredentials{}, errors.Join(errs...)
+}
@@ -0,0 +1,115 @@
+package credentials
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnvProvider(t *testing.T) {
+	t.Setenv("TEST_URL", "https://example.com")
+	t.Setenv("TEST_API_KEY", "key")
+	t.Setenv("TEST_PASSKEY", "pass")
+	t.Setenv("TEST_DEVICE_ID", "device")
+	t.Setenv("TEST_EXTRA_HEADERS", "x-one=1, x-two=2")
+
+	cred, err := EnvProvider{Prefix: "TEST_"}.Retrieve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.URL != "https://example.com" || cred.APIKey != "key" || cred.Passkey != "pass" || cred.DeviceId != "device" {
+		t.Fatalf("unexpected credentials: %+v", cred)
+	}
+	if cred.ExtraHeaders["x-one"] != "1" || cred.ExtraHeaders["x-two"] != "2" {
+		t.Fatalf("unexpected extra headers: %v", cred.ExtraHeaders)
+	}
+
+	_, err = EnvProvider{Prefix: "UNSET_"}.Retrieve(context.Background())
+	if !errors.Is(err, ErrNoCredentials) {
+		t.Fatalf("expected ErrNoCredentials, got %v", err)
+	}
+}
+
+func TestFileProvider(t *testing.T) {
+	dir := t.TempDir()
+	yamlFile := filepath.Join(dir, "credentials.yaml")
+	jsonFile := filepath.Join(dir, "credentials.json")
+	if err := os.WriteFile(yamlFile, []byte("url: https://yaml\napiKey: key\npasskey: pass\nintegrationId: integration\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(jsonFile, []byte(`{"url":"https://json","apiKey":"key","passkey":"pass","deviceId":"device"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cred, err := FileProvider{Path: yamlFile}.Retrieve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.URL != "https://yaml" || cred.IntegrationId != "integration" {
+		t.Fatalf("unexpected yaml credentials: %+v", cred)
+	}
+
+	cred, err = FileProvider{Path: jsonFile}.Retrieve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.URL != "https://json" || cred.DeviceId != "device" {
+		t.Fatalf("unexpected json credentials: %+v", cred)
+	}
+
+	_, err = FileProvider{Path: filepath.Join(dir, "missing.yaml")}.Retrieve(context.Background())
+	if !errors.Is(err, ErrNoCredentials) {
+		t.Fatalf("expected ErrNoCredentials, got %v", err)
+	}
+}
+
+func TestSecretDirProvider(t *testing.T) {
+	dir := t.TempDir()
+	for name, value := range map[string]string{"url": "https://secret\n", "apiKey": "key", "passkey": " pass ", "extraHeaders": "X-Tenant=a\nX-Site = b\n"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(value), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cred, err := SecretDirProvider{Dir: dir}.Retrieve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.URL != "https://secret" || cred.APIKey != "key" || cred.Passkey != "pass" || cred.DeviceId != "" ||
+		cred.ExtraHeaders["X-Tenant"] != "a" || cred.ExtraHeaders["X-Site"] != "b" {
+		t.Fatalf("unexpected credentials: %+v", cred)
+	}
+}
+
+func TestChainProvider(t *testing.T) {
+	want := APICredentials{URL: "https://static", APIKey: "key", Passkey: "pass", DeviceId: "device"}
+	chain := ChainProvider{
+		EnvProvider{Prefix: "UNSET_"},
+		FileProvider{Path: filepath.Join(t.TempDir(), "missing.yaml")},
+		want,
+	}
+	cred, err := chain.Retrieve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.URL != want.URL {
+		t.Fatalf("expected static credentials, got %+v", cred)
+	}
+
+	_, err = ChainProvider{EnvProvider{Prefix: "UNSET_"}}.Retrieve(context.Background())
+	if !errors.Is(err, ErrNoCredentials) {
+		t.Fatalf("expected ErrNoCredentials, got %v", err)
+	}
+
+	// A corrupt file is an error, not a reason to use the next source.
+	corrupt := filepath.Join(t.TempDir(), "credentials.yaml")
+	if err := os.WriteFile(corrupt, []byte("url: [unterminated"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ChainProvider{FileProvider{Path: corrupt}, want}.Retrieve(context.Background())
+	if err == nil || errors.Is(err, ErrNoCredentials) {
+		t.Fatalf("expected the corrupt file to fail the chain, got %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+/*
+ * NTT Security Holdings Go Library for Samurai
+ * Copyright 2023 NTT Security Holdings
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package credentials
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Redacted replaces secret values whenever credentials are formatted.
+const Redacted = "[REDACTED]"
+
+func redact(value string) string {
+	if value == "" {
+		return ""
+	}
+	return Redacted
+}
+
+// redactedURL hides any password embedded in the URL.
+func redactedURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return redact(raw)
+	}
+	return u.Redacted()
+}
+
+// redactedHeaders keeps header names but hides their values, since extra
+// headers are commonly used to carry proxy or gateway tokens.
+func (c APICredentials) redactedHeaders() []string {
+	headers := make([]string, 0, len(c.ExtraHeaders))
+	for key, value := range c.ExtraHeaders {
+		headers = append(headers, key+":"+redact(value))
+	}
+	sort.Strings(headers)
+	return headers
+}
+
+// String implements fmt.Stringer and is used for %v, %+v and %s, as well as
+// by logrus' text formatter. APIKey, Passkey and extra header values are
+// never printed.
+func (c APICredentials) String() string {
+	return fmt.Sprintf("{URL:%s APIKey:%s Passkey:%s DeviceId:%s IntegrationId:%s ExtraHeaders:[%s]}",
+		redactedURL(c.URL), redact(c.APIKey), redact(c.Passkey), c.DeviceId, c.IntegrationId, strings.Join(c.redactedHeaders(), " "))
+}
+
+// GoString implements fmt.GoStringer so %#v is redacted as well.
+func (c APICredentials) GoString() string {
+	return "credentials.APICredentials" + c.String()
+}
+
+// LogValue implements slog.LogValuer.
+func (c APICredentials) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("url", redactedURL(c.URL)),
+		slog.String("apiKey", redact(c.APIKey)),
+		slog.String("passkey", redact(c.Passkey)),
+		slog.String("deviceId", c.DeviceId),
+		slog.String("integrationId", c.IntegrationId),
+		slog.Any("extraHeaders", c.redactedHeaders()),
+	)
+}
+
+// Redacted returns a copy with the secrets String hides replaced, for
+// logging credentials as a JSON field.
+func (c APICredentials) Redacted() APICredentials {
+	redacted := c
+	redacted.URL = redactedURL(c.URL)
+	redacted.APIKey = redact(c.APIKey)
+	redacted.Passkey = redact(c.Passkey)
+	if c.ExtraHeaders != nil {
+		redacted.ExtraHeaders = make(map[string]string, len(c.ExtraHeaders))
+		for key, value := range c.ExtraHeaders {
+			redacted.ExtraHeaders[key] = redact(value)
+		}
+	}
+	return redacted
+}
+
+// RedactHook is a logrus hook that replaces credentials in log fields with
+// their Redacted copy, so that formatters which encode fields as JSON do
+// not print secrets:
+//
+//	log.AddHook(credentials.RedactHook{})
+type RedactHook struct{}
+
+func (RedactHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (RedactHook) Fire(entry *log.Entry) error {
+	for key, value := range entry.Data {
+		switch cred := value.(type) {
+		case APICredentials:
+			entry.Data[key] = cred.Redacted()
+		case *APICredentials:
+			if cred != nil {
+				entry.Data[key] = cred.Redacted()
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+/*
+ * NTT Security Holdings Go Library for Samurai
+ * Copyright 2023 NTT Security Holdings
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package credentials
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// WatchOptions configures a WatchingFileProvider.
+type WatchOptions struct {
+	// Interval between checks of the file, defaults to 10 seconds.
+	Interval time.Duration
+	// OnRotate, when set, is called after new credentials have been
+	// validated and swapped in.
+	OnRotate func(previous, current APICredentials)
+}
+
+// WatchingFileProvider serves credentials from a YAML or JSON file and
+// reloads them when the file content changes. Reloaded credentials are
+// validated before they replace the current ones, so a half-written or
+// broken file keeps the last good credentials in use. Uploads already in
+// progress keep the credentials they started with.
+type WatchingFileProvider struct {
+	file     FileProvider
+	opts     WatchOptions
+	current  atomic.Pointer[APICredentials]
+	digest   []byte
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// NewWatchingFileProvider loads and validates the file at path and starts
+// watching it for changes. Call Close to stop watching.
+func NewWatchingFileProvider(path string, opts WatchOptions) (*WatchingFileProvider, error) {
+	if opts.Interval <= 0 {
+		opts.Interval = 10 * time.Second
+	}
+	p := &WatchingFileProvider{
+		file: FileProvider{Path: path},
+		opts: opts,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	cred, digest, err := p.load()
+	if err != nil {
+		return nil, err
+	}
+	p.current.Store(&cred)
+	p.digest = digest
+
+	go p.watch()
+	return p, nil
+}
+
+func (p *WatchingFileProvider) Retrieve(ctx context.Context) (APICredentials, error) {
+	return *p.current.Load(), nil
+}
+
+// Close stops watching the file. Retrieve keeps returning the last loaded
+// credentials.
+func (p *WatchingFileProvider) Close() error {
+	p.stopOnce.Do(func() { close(p.stop) })
+	<-p.done
+	return nil
+}
+
+func (p *WatchingFileProvider) load() (APICredentials, []byte, error) {
+	data, err := os.ReadFile(filepath.Clean(p.file.Path))
+	if err != nil {
+		return APICredentials{}, nil, err
+	}
+	digest := sha256.Sum256(data)
+	cred, err := p.file.parse(data)
+	if err != nil {
+		return APICredentials{}, digest[:], err
+	}
+	if err := cred.Validate(); err != nil {
+		return APICredentials{}, digest[:], err
+	}
+	return cred, digest[:], nil
+}
+
+func (p *WatchingFileProvider) watch() {
+	defer close(p.done)
+	ticker := time.NewTicker(p.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.reload()
+		}
+	}
+}
+
+func (p *WatchingFileProvider) reload() {
+	cred, digest, err := p.load()
+	if digest == nil {
+		log.Warnf("Could not read credentials file %s, keeping current credentials: %v", p.file.Path, err)
+		return
+	}
+	if bytes.Equal(digest, p.digest) {
+		return
+	}
+	// Remember the digest even when the content is invalid so the warning is
+	// logged once per change rather than on every tick.
+	p.digest = digest
+	if err != nil {
+		log.Warnf("Ignoring changed credentials file %s, keeping current credentials: %v", p.file.Path, err)
+		return
+	}
+	previous := p.current.Swap(&cred)
+	log.Infof("Credentials rotated from %s", p.file.Path)
+	if p.opts.OnRotate != nil {
+		p.opts.OnRotate(*previous, cred)
+	}
+}
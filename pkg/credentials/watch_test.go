@@ -0,0 +1,67 @@
+package credentials
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchingFileProviderRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials.yaml")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("url: https://host\napiKey: old\npasskey: pass\ndeviceId: device\n")
+
+	rotated := make(chan APICredentials, 1)
+	provider, err := NewWatchingFileProvider(path, WatchOptions{
+		Interval: 10 * time.Millisecond,
+		OnRotate: func(previous, current APICredentials) {
+			if previous.APIKey != "old" {
+				t.Errorf("expected previous apiKey old, got %q", previous.APIKey)
+			}
+			rotated <- current
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Close()
+
+	// Invalid content must not replace the current credentials.
+	write("url: https://host\napiKey: broken\n")
+	time.Sleep(50 * time.Millisecond)
+	cred, _ := provider.Retrieve(context.Background())
+	if cred.APIKey != "old" {
+		t.Fatalf("expected invalid file to be ignored, got apiKey %q", cred.APIKey)
+	}
+
+	write("url: https://host\napiKey: new\npasskey: pass\ndeviceId: device\n")
+	select {
+	case current := <-rotated:
+		if current.APIKey != "new" {
+			t.Fatalf("expected rotated apiKey new, got %q", current.APIKey)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("credentials were not rotated")
+	}
+	cred, _ = provider.Retrieve(context.Background())
+	if cred.APIKey != "new" {
+		t.Fatalf("expected Retrieve to return new apiKey, got %q", cred.APIKey)
+	}
+}
+
+func TestWatchingFileProviderRejectsInvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials.yaml")
+	if err := os.WriteFile(path, []byte("url: https://host\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewWatchingFileProvider(path, WatchOptions{}); err == nil {
+		t.Fatal("expected error for incomplete credentials")
+	}
+}
@@ -0,0 +1,88 @@
+/*
+ * NTT Security Holdings Go Library for Samurai
+ * Copyright 2023 NTT Security Holdings
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package transmitter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/SamuraiMDR/samurai-go/pkg/generator"
+	"golang.org/x/sync/errgroup"
+)
+
+// alertConcurrency bounds the alerts SendAlerts uploads at the same time.
+const alertConcurrency = 4
+
+// SendAlert validates alert and uploads it as a bouncer payload. The sha is
+// computed first when it is not set yet. Validation failures are returned as
+// a *ContentError wrapping ErrInvalidAlert before any token is requested.
+func (client Client) SendAlert(ctx context.Context, alert *generator.AlertV1) (UploadResult, error) {
+	data, err := marshalAlert(alert)
+	if err != nil {
+		return UploadResult{}, err
+	}
+	return client.SendBytesContext(ctx, data, FileDetails{
+		SourceFilename: fmt.Sprintf("alert-%s.json", alert.Sha),
+		FileSuffix:     "json",
+		PayloadType:    PayloadBouncer,
+	})
+}
+
+// SendAlerts uploads each alert like SendAlert, several at a time. The
+// results are in the order of alerts; the error joins the errors of the
+// alerts that failed, the others are still sent.
+func (client Client) SendAlerts(ctx context.Context, alerts []*generator.AlertV1) ([]UploadResult, error) {
+	results := make([]UploadResult, len(alerts))
+	errs := make([]error, len(alerts))
+	var group errgroup.Group
+	group.SetLimit(alertConcurrency)
+	for i, alert := range alerts {
+		group.Go(func() error {
+			results[i], errs[i] = client.SendAlert(ctx, alert)
+			if errs[i] != nil {
+				errs[i] = fmt.Errorf("alert %d: %w", i, errs[i])
+			}
+			return nil
+		})
+	}
+	group.Wait()
+	return results, errors.Join(errs...)
+}
+
+// marshalAlert sets the sha of alert if needed, validates and serializes it.
+func marshalAlert(alert *generator.AlertV1) ([]byte, error) {
+	if alert == nil {
+		return nil, &ContentError{PayloadType: PayloadBouncer, Err: fmt.Errorf("nil alert: %w", ErrInvalidAlert)}
+	}
+	// SetSha exits the process when the alert cannot be serialized, so
+	// check that first.
+	if _, err := json.Marshal(alert); err != nil {
+		return nil, &ContentError{PayloadType: PayloadBouncer, Err: fmt.Errorf("%v: %w", err, ErrInvalidAlert)}
+	}
+	if alert.Sha == "" {
+		if alert.Context == nil {
+			alert.Context = make(map[string]interface{})
+		}
+		alert.SetSha()
+	}
+	if err := validateAlert(*alert); err != nil {
+		return nil, &ContentError{PayloadType: PayloadBouncer, Err: err}
+	}
+	return json.Marshal(alert)
+}
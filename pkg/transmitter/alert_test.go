@@ -0,0 +1,81 @@
+package transmitter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/SamuraiMDR/samurai-go/pkg/generator"
+	"github.com/SamuraiMDR/samurai-go/pkg/transmitter/transmittertest"
+)
+
+func TestSendAlert(t *testing.T) {
+	server, client := testServer(t, Settings{})
+	alert := validAlert()
+	alert.Sha = ""
+
+	upload, err := client.SendAlert(context.Background(), &alert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alert.Sha == "" || upload.PayloadType != PayloadBouncer || upload.Suffix != "json" {
+		t.Fatalf("unexpected result %+v, sha %q", upload, alert.Sha)
+	}
+	object, ok := server.Object(upload.Key)
+	if !ok {
+		t.Fatalf("expected object %v", upload.Key)
+	}
+	var stored generator.AlertV1
+	if err := json.Unmarshal(object.Data, &stored); err != nil || stored.Sha != alert.Sha {
+		t.Fatalf("expected stored alert, got %s, %v", object.Data, err)
+	}
+}
+
+func TestSendAlertInvalid(t *testing.T) {
+	server, client := testServer(t, Settings{})
+	alert := validAlert()
+	alert.Action = "DROP"
+
+	_, err := client.SendAlert(context.Background(), &alert)
+	var contentErr *ContentError
+	if !errors.As(err, &contentErr) || !errors.Is(err, ErrInvalidAlert) {
+		t.Fatalf("expected invalid alert ContentError, got %v", err)
+	}
+	alert = validAlert()
+	alert.Context["bad"] = func() {}
+	if _, err := client.SendAlert(context.Background(), &alert); !errors.Is(err, ErrInvalidAlert) {
+		t.Fatalf("expected unserializable alert to be rejected, got %v", err)
+	}
+	if server.Requests(transmittertest.OpToken) != 0 {
+		t.Fatal("invalid alerts must be rejected before requesting a token")
+	}
+}
+
+func TestSendAlerts(t *testing.T) {
+	server, client := testServer(t, Settings{})
+	alerts := make([]*generator.AlertV1, 6)
+	for i := range alerts {
+		alert := validAlert()
+		alert.Name = string(rune('a' + i))
+		alert.Sha = ""
+		alerts[i] = &alert
+	}
+	alerts[2].Action = ""
+
+	results, err := client.SendAlerts(context.Background(), alerts)
+	if !errors.Is(err, ErrInvalidAlert) {
+		t.Fatalf("expected one invalid alert, got %v", err)
+	}
+	if len(results) != len(alerts) || results[2].Key != "" {
+		t.Fatalf("unexpected results %+v", results)
+	}
+	if len(server.Objects()) != 5 {
+		t.Fatalf("expected 5 uploads, got %d", len(server.Objects()))
+	}
+	for i, result := range results {
+		if i != 2 && result.SourceFilename != "alert-"+alerts[i].Sha+".json" {
+			t.Fatalf("result %d does not match its alert: %+v", i, result)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+/*
+ * NTT Security Holdings Go Library for Samurai
+ * Copyright 2023 NTT Security Holdings
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package transmitter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/SamuraiMDR/samurai-go/gen/version"
+	"github.com/SamuraiMDR/samurai-go/pkg/credentials"
+)
+
+// UserAgent is sent with every request to the payload API.
+var UserAgent = "samurai-go/" + version.Version
+
+// apiTimeout bounds a single request to the payload API.
+const apiTimeout = 10 * time.Second
+
+// APIError is returned when the payload API answers with an unexpected
+// status code.
+type APIError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("status code: %d, Body: %v", e.StatusCode, e.Body)
+}
+
+// APIClient builds and sends requests to the /cts/payload endpoint. Every
+// request carries the same authentication headers, user agent and extra
+// headers, and errors are decoded the same way for all operations.
+type APIClient struct {
+	credentials credentials.APICredentials
+	httpClient  *http.Client
+}
+
+// NewAPIClient returns a client for the payload API using the given
+// credentials. It reuses a single keep-alive connection across requests.
+func NewAPIClient(settings Settings, cred credentials.APICredentials) (*APIClient, error) {
+	if err := cred.Validate(); err != nil {
+		return nil, err
+	}
+	return &APIClient{
+		credentials: cred,
+		httpClient:  &http.Client{Transport: newTransport(settings), Timeout: apiTimeout},
+	}, nil
+}
+
+// Close releases idle connections held by the client.
+func (c *APIClient) Close() {
+	c.httpClient.CloseIdleConnections()
+}
+
+// do posts body as JSON and decodes a 200 response into result.
+func (c *APIClient) do(ctx context.Context, body interface{}, result interface{}) error {
+	_, err := c.post(ctx, body, result)
+	return err
+}
+
+// post is do that also returns the response headers when a response was
+// received.
+func (c *APIClient) post(ctx context.Context, body interface{}, result interface{}) (http.Header, error) {
+	status, header, bodyBytes, err := c.send(ctx, body)
+	if err != nil {
+		return header, err
+	}
+
+	switch status {
+	case http.StatusOK:
+		return header, json.Unmarshal(bodyBytes, result)
+	case http.StatusUnsupportedMediaType:
+		return header, ErrUnknownPayload
+	default:
+		return header, &APIError{StatusCode: status, Body: string(bodyBytes)}
+	}
+}
+
+// send posts body as JSON and returns the status code, headers and body of
+// the response.
+func (c *APIClient) send(ctx context.Context, body interface{}) (int, http.Header, []byte, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, c.credentials.URL+"/cts/payload", bytes.NewReader(data))
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", UserAgent)
+	request.Header.Add("x-api-key", c.credentials.APIKey)
+	request.Header.Add("passkey", c.credentials.Passkey)
+	if c.credentials.IntegrationId != "" {
+		request.Header.Add("integration_id", c.credentials.IntegrationId)
+		request.Header.Add("integrationid", c.credentials.IntegrationId)
+	} else {
+		request.Header.Add("device_id", c.credentials.DeviceId)
+		request.Header.Add("deviceid", c.credentials.DeviceId)
+	}
+	for key, value := range c.credentials.ExtraHeaders {
+		request.Header.Add(key, value)
+	}
+
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return 0, nil, nil, redactError(err)
+	}
+	defer response.Body.Close()
+	bodyBytes, err := io.ReadAll(response.Body)
+	return response.StatusCode, response.Header, bodyBytes, err
+}
+
+// requestToken asks for a SAS URL (azure) or a multipart upload (s3).
+func (c *APIClient) requestToken(ctx context.Context, request sas) (sasResult, error) {
+	var result sasResult
+	err := c.do(ctx, request, &result)
+	return result, err
+}
+
+// GetSignedURL returns a presigned URL for uploading one part of an S3
+// multipart upload.
+func (c *APIClient) GetSignedURL(ctx context.Context, key string, uploadId string, part int) (string, error) {
+	var result signedURLMessage
+	err := c.do(ctx, signedURL{"GET_SIGNED_URL", key, uploadId, part}, &result)
+	return result.SignedURL, err
+}
+
+// CompleteMultipartUpload finishes an S3 multipart upload. Parts must be
+// sorted by part number.
+func (c *APIClient) CompleteMultipartUpload(ctx context.Context, key string, uploadId string, parts []Part) (string, error) {
+	var result completeMultipartUploadMessage
+	err := c.do(ctx, completeMultipartUpload{"COMPLETE_MULTIPART_UPLOAD", key, uploadId, parts}, &result)
+	return result.Message, err
+}
+
+// AbortMultipartUpload discards an S3 multipart upload and its parts.
+func (c *APIClient) AbortMultipartUpload(ctx context.Context, key string, uploadId string) (string, error) {
+	var result abortMultipartUploadMessage
+	err := c.do(ctx, abortedMultipartUpload{"ABORT_MULTIPART_UPLOAD", key, uploadId}, &result)
+	return result.Message, err
+}
@@ -0,0 +1,89 @@
+package transmitter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/SamuraiMDR/samurai-go/pkg/credentials"
+)
+
+func TestAPIClientHeadersForAllOperations(t *testing.T) {
+	var seen []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		event, _ := body["event_type"].(string)
+		seen = append(seen, event)
+		if r.Header.Get("integration_id") != "integration" || r.Header.Get("device_id") != "" {
+			t.Errorf("%s: unexpected id headers %v", event, r.Header)
+		}
+		if r.Header.Get("x-api-key") != "key" || r.Header.Get("passkey") != "pass" {
+			t.Errorf("%s: missing auth headers", event)
+		}
+		if r.Header.Get("x-proxy") != "proxy" || r.Header.Get("User-Agent") != UserAgent {
+			t.Errorf("%s: missing extra header or user agent", event)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"signed_url": "https://part", "Message": "ok", "profile_type": "s3"})
+	}))
+	defer server.Close()
+
+	api, err := NewAPIClient(Settings{}, credentials.APICredentials{
+		URL:           server.URL,
+		APIKey:        "key",
+		Passkey:       "pass",
+		IntegrationId: "integration",
+		ExtraHeaders:  map[string]string{"x-proxy": "proxy"},
+		AllowHTTP:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer api.Close()
+	ctx := context.Background()
+
+	if _, err := api.requestToken(ctx, sas{Payload: "pcap"}); err != nil {
+		t.Fatal(err)
+	}
+	if url, err := api.GetSignedURL(ctx, "key", "upload", 1); err != nil || url != "https://part" {
+		t.Fatalf("GetSignedURL() = %q, %v", url, err)
+	}
+	if _, err := api.CompleteMultipartUpload(ctx, "key", "upload", []Part{{ETag: "e", PartNumber: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := api.AbortMultipartUpload(ctx, "key", "upload"); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 4 {
+		t.Fatalf("expected 4 requests, got %v", seen)
+	}
+}
+
+func TestAPIClientErrors(t *testing.T) {
+	status := http.StatusUnsupportedMediaType
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte("denied"))
+	}))
+	defer server.Close()
+
+	api, err := NewAPIClient(Settings{}, credentials.APICredentials{URL: server.URL, APIKey: "key", Passkey: "pass", DeviceId: "device", AllowHTTP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer api.Close()
+
+	if _, err := api.requestToken(context.Background(), sas{}); err != ErrUnknownPayload {
+		t.Fatalf("expected ErrUnknownPayload, got %v", err)
+	}
+
+	status = http.StatusForbidden
+	_, err = api.GetSignedURL(context.Background(), "key", "upload", 1)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusForbidden || apiErr.Body != "denied" {
+		t.Fatalf("expected APIError 403, got %v", err)
+	}
+}
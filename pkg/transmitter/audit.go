@@ -0,0 +1,441 @@
+/*
+ * NTT Security Holdings Go Library for Samurai
+ * Copyright 2023 NTT Security Holdings
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package transmitter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultAuditLogMaxSize is the size at which the audit log is rotated
+// without Settings.AuditLogMaxSize.
+const defaultAuditLogMaxSize = 100 * 1024 * 1024
+
+// auditRotationLayout names rotated audit logs so they sort by age.
+const auditRotationLayout = "20060102T150405.000000000Z"
+
+var ErrAuditChainBroken = errors.New("audit log hash chain broken")
+
+// Audit log outcomes.
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+	AuditSkipped = "skipped"
+	AuditDryRun  = "dry_run"
+	// AuditRecovered records that an incomplete entry, written when the
+	// process stopped, was moved out of the log.
+	AuditRecovered = "recovered"
+)
+
+// AuditEntry is one line of the audit log, written for every upload
+// attempt. Hash is the SHA-256 of the line as written up to Hash, and Prev
+// the Hash of the entry before it, so that changed, removed or reordered
+// entries break the chain.
+type AuditEntry struct {
+	Seq                 int64             `json:"seq"`
+	Started             time.Time         `json:"started"`
+	Finished            time.Time         `json:"finished"`
+	SourceFilename      string            `json:"source_filename"`
+	Size                int64             `json:"size"`
+	SHA256              string            `json:"sha256"`
+	PayloadType         string            `json:"payload_type"`
+	CustomKey           string            `json:"custom_key,omitempty"`
+	CustomValue         string            `json:"custom_value,omitempty"`
+	Metadata            map[string]string `json:"metadata,omitempty"`
+	DestinationFilename string            `json:"destination_filename,omitempty"`
+	Backend             string            `json:"backend,omitempty"`
+	Key                 string            `json:"key,omitempty"`
+	BlobID              string            `json:"blob_id,omitempty"`
+	Outcome             string            `json:"outcome"`
+	ErrorClass          string            `json:"error_class,omitempty"`
+	Error               string            `json:"error,omitempty"`
+	// DispositionError is why a successfully uploaded file could not be
+	// disposed of.
+	DispositionError string `json:"disposition_error,omitempty"`
+	Prev             string `json:"prev"`
+	// Hash must stay the last field, it is appended to the hashed line.
+	Hash string `json:"hash,omitempty"`
+}
+
+// auditHashField starts the Hash field at the end of an audit log line.
+const auditHashField = `,"hash":"`
+
+// sealAuditEntry serializes e without Hash, hashes exactly those bytes and
+// appends the hash as the last field. It returns the line and the hash.
+func sealAuditEntry(e AuditEntry) ([]byte, string, error) {
+	e.Hash = ""
+	body, err := json.Marshal(e)
+	if err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(body)
+	hash := hex.EncodeToString(sum[:])
+	line := append(body[:len(body)-1:len(body)-1], auditHashField+hash+`"}`...)
+	return line, hash, nil
+}
+
+// openAuditLine checks that line ends with the hash of the bytes before it
+// and decodes it. Unknown fields are rejected.
+func openAuditLine(line []byte) (AuditEntry, error) {
+	var entry AuditEntry
+	i := bytes.LastIndex(line, []byte(auditHashField))
+	if i < 0 || !bytes.HasSuffix(line, []byte(`"}`)) || i+len(auditHashField) > len(line)-2 {
+		return entry, fmt.Errorf("entry does not end with a hash")
+	}
+	sum := sha256.Sum256(append(line[:i:i], '}'))
+	if hex.EncodeToString(sum[:]) != string(line[i+len(auditHashField):len(line)-2]) {
+		return entry, fmt.Errorf("hash does not match entry")
+	}
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&entry); err != nil {
+		return entry, err
+	}
+	return entry, nil
+}
+
+// auditClass sorts an upload error into a coarse class for the audit log.
+func auditClass(err error) string {
+	var contentErr *ContentError
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrSkipped):
+		return "skipped"
+	case errors.Is(err, ErrShutdown):
+		return "shutdown"
+	case errors.Is(err, context.Canceled):
+		return "cancelled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, ErrSuffixNotAllowed), errors.Is(err, ErrPayloadTooLarge), errors.Is(err, ErrUnknownPayload):
+		return "payload"
+	case errors.As(err, &contentErr):
+		return "content"
+	case errors.Is(err, ErrInvalidDestination):
+		return "destination"
+	case errors.Is(err, ErrFileExists):
+		return "exists"
+	}
+	return "upload"
+}
+
+// auditLog appends hash chained entries to a JSONL file and rotates it by
+// size. A nil auditLog records nothing.
+type auditLog struct {
+	path    string
+	maxSize int64
+
+	mu   sync.Mutex
+	seq  int64
+	prev string
+}
+
+// newAuditLog opens the audit log at path and continues the hash chain of
+// its last entry, or of the last rotated file.
+func newAuditLog(path string, maxSize int64) (*auditLog, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if maxSize <= 0 {
+		maxSize = defaultAuditLogMaxSize
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("could not create audit log directory: %v", err)
+	}
+	a := &auditLog{path: path, maxSize: maxSize}
+	torn, err := moveTornAuditLine(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not recover audit log %v: %v", path, err)
+	}
+	files, err := AuditLogFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		last, err := lastAuditEntry(files[i])
+		if err != nil {
+			return nil, fmt.Errorf("could not read audit log %v: %v", files[i], err)
+		}
+		if last != nil {
+			a.seq, a.prev = last.Seq, last.Hash
+			break
+		}
+	}
+	if torn != "" {
+		now := time.Now().UTC()
+		entry := AuditEntry{Started: now, Finished: now, Outcome: AuditRecovered, Error: "incomplete entry moved to " + torn}
+		if err := a.record(entry); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// moveTornAuditLine moves an incomplete last line of the audit log at path,
+// left behind when the process stopped while writing it, to a file next to
+// it and returns that file's name. It returns "" when path ends with a
+// complete line or does not exist.
+func moveTornAuditLine(path string) (string, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	// Find the end of the last complete line, reading backwards.
+	end := info.Size()
+	buf := make([]byte, 64*1024)
+	for end > 0 {
+		n := int64(len(buf))
+		if end < n {
+			n = end
+		}
+		if _, err := file.ReadAt(buf[:n], end-n); err != nil {
+			return "", err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			end = end - n + int64(i) + 1
+			break
+		}
+		end -= n
+	}
+	if end == info.Size() {
+		return "", nil
+	}
+	tail := make([]byte, info.Size()-end)
+	if _, err := file.ReadAt(tail, end); err != nil {
+		return "", err
+	}
+	torn := path + ".torn-" + time.Now().UTC().Format(auditRotationLayout)
+	if err := os.WriteFile(torn, tail, 0600); err != nil {
+		return "", err
+	}
+	if err := file.Truncate(end); err != nil {
+		return "", err
+	}
+	if err := file.Sync(); err != nil {
+		return "", err
+	}
+	log.Warnf("Moved incomplete last entry of audit log %v to %v", path, torn)
+	return torn, nil
+}
+
+// lastAuditEntry returns the last entry in path, or nil when it has none.
+func lastAuditEntry(path string) (*AuditEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var last []byte
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) > 0 {
+			last = append(last[:0], scanner.Bytes()...)
+		}
+	}
+	if err := scanner.Err(); err != nil || last == nil {
+		return nil, err
+	}
+	var entry AuditEntry
+	if err := json.Unmarshal(last, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// record appends e to the log, filling in Seq, Prev and Hash. Each entry is
+// synced to disk before record returns.
+func (a *auditLog) record(e AuditEntry) error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e.Seq = a.seq + 1
+	e.Prev = a.prev
+	data, hash, err := sealAuditEntry(e)
+	if err != nil {
+		return err
+	}
+	e.Hash = hash
+	data = append(data, '\n')
+
+	if info, err := os.Stat(a.path); err == nil && info.Size() > 0 && info.Size()+int64(len(data)) > a.maxSize {
+		rotated := a.path + "." + time.Now().UTC().Format(auditRotationLayout)
+		if err := os.Rename(a.path, rotated); err != nil {
+			return fmt.Errorf("could not rotate audit log: %v", err)
+		}
+		log.Infof("Rotated audit log to %v", rotated)
+	}
+	file, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	a.seq, a.prev = e.Seq, e.Hash
+	return nil
+}
+
+// audit records an upload attempt of fd that started at started.
+func (client Client) audit(started time.Time, fd FileDetails, upload UploadResult, err error) {
+	entry := AuditEntry{
+		Started:             started.UTC(),
+		Finished:            time.Now().UTC(),
+		SourceFilename:      fd.SourceFilename,
+		Size:                upload.Size,
+		SHA256:              upload.SHA256,
+		PayloadType:         fd.PayloadType,
+		CustomKey:           fd.CustomKey,
+		CustomValue:         fd.CustomValue,
+		Metadata:            fd.Metadata,
+		DestinationFilename: upload.DestinationFilename,
+		Backend:             upload.Backend,
+		Key:                 upload.Key,
+		BlobID:              upload.BlobID,
+		Outcome:             AuditSuccess,
+		ErrorClass:          auditClass(err),
+	}
+	switch {
+	case errors.Is(err, ErrSkipped):
+		entry.Outcome = AuditSkipped
+	case err != nil:
+		entry.Outcome = AuditFailure
+	case upload.DryRun:
+		entry.Outcome = AuditDryRun
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if upload.DispositionError != nil {
+		entry.DispositionError = upload.DispositionError.Error()
+	}
+	if err := client.auditLog.record(entry); err != nil {
+		log.Errorf("Could not write audit log entry for %v: %v", fd.SourceFilename, err)
+	}
+}
+
+// AuditLogFiles returns the rotated audit logs of path, oldest first,
+// followed by path itself if it exists.
+func AuditLogFiles(path string) ([]string, error) {
+	rotated, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, name := range rotated {
+		suffix := name[len(path)+1:]
+		if _, err := time.Parse(auditRotationLayout, suffix); err == nil {
+			files = append(files, name)
+		}
+	}
+	sort.Strings(files)
+	if _, err := os.Stat(path); err == nil {
+		files = append(files, path)
+	}
+	return files, nil
+}
+
+// AuditAnchor is the last entry before the oldest audit log that is kept,
+// for verifying a log whose older files were archived or removed.
+type AuditAnchor struct {
+	Seq  int64
+	Hash string
+}
+
+// VerifyAuditLog checks the hash chain across the audit log at path and its
+// rotated files and returns the number of entries checked. The chain must
+// start with the first entry ever written, so removed leading entries are
+// detected. A broken chain is reported as ErrAuditChainBroken with the file
+// and line.
+func VerifyAuditLog(path string) (int, error) {
+	return VerifyAuditLogFrom(path, AuditAnchor{})
+}
+
+// VerifyAuditLogFrom is VerifyAuditLog for a chain that continues anchor.
+func VerifyAuditLogFrom(path string, anchor AuditAnchor) (int, error) {
+	files, err := AuditLogFiles(path)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	prev := anchor.Hash
+	seq := anchor.Seq
+	for _, name := range files {
+		file, err := os.Open(name)
+		if err != nil {
+			return count, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		line := 0
+		for scanner.Scan() {
+			line++
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			entry, err := openAuditLine(scanner.Bytes())
+			if err != nil {
+				file.Close()
+				return count, fmt.Errorf("%v:%d: %v: %w", name, line, err, ErrAuditChainBroken)
+			}
+			if entry.Prev != prev || entry.Seq != seq+1 {
+				file.Close()
+				return count, fmt.Errorf("%v:%d: entry %d: %w", name, line, entry.Seq, ErrAuditChainBroken)
+			}
+			prev, seq = entry.Hash, entry.Seq
+			count++
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
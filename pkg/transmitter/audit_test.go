@@ -0,0 +1,249 @@
+package transmitter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/SamuraiMDR/samurai-go/pkg/transmitter/transmittertest"
+)
+
+func readAuditLog(t *testing.T, path string) []AuditEntry {
+	files, err := AuditLogFiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []AuditEntry
+	for _, name := range files {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			var entry AuditEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				t.Fatal(err)
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func TestSendFileAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit", "audit.log")
+	server, client := testServer(t, Settings{AuditLog: path, Catalog: DefaultCatalog()})
+	data := []byte("data")
+	file := writeTestFile(t, "file.pcap", data)
+
+	fd := FileDetails{SourceFilename: file, DestinationFilename: "file.pcap", PayloadType: "pcap", Metadata: map[string]string{"site": "oslo"}}
+	if err := client.SendFile(fd); err != nil {
+		t.Fatal(err)
+	}
+	server.Inject(transmittertest.OpPutPart, 0, transmittertest.Fault{StatusCode: http.StatusInternalServerError})
+	fd.DestinationFilename = "other.pcap"
+	if err := client.SendFile(fd); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := client.SendFile(FileDetails{SourceFilename: file, PayloadType: "bouncer"}); !errors.Is(err, ErrSuffixNotAllowed) {
+		t.Fatalf("expected ErrSuffixNotAllowed, got %v", err)
+	}
+
+	entries := readAuditLog(t, path)
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+	first := entries[0]
+	if first.Outcome != AuditSuccess || first.Key != "pcap/file.pcap" || first.SHA256 != sha256Hex(data) || first.Size != 4 || first.Metadata["site"] != "oslo" || first.Prev != "" {
+		t.Fatalf("unexpected entry %+v", first)
+	}
+	if entries[1].Outcome != AuditFailure || entries[1].ErrorClass != "upload" || entries[1].Prev != first.Hash {
+		t.Fatalf("unexpected entry %+v", entries[1])
+	}
+	if entries[2].ErrorClass != "payload" || entries[2].Seq != 3 {
+		t.Fatalf("unexpected entry %+v", entries[2])
+	}
+	if n, err := VerifyAuditLog(path); err != nil || n != 3 {
+		t.Fatalf("expected 3 verified entries, got %d, %v", n, err)
+	}
+}
+
+func TestAuditLogRotationAndRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := newAuditLog(path, 600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := audit.record(AuditEntry{SourceFilename: "file.pcap", Outcome: AuditSuccess}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A new client continues the chain.
+	audit, err = newAuditLog(path, 600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := audit.record(AuditEntry{SourceFilename: "file.pcap", Outcome: AuditSuccess}); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := AuditLogFiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) < 2 || files[len(files)-1] != path {
+		t.Fatalf("expected rotated files followed by %s, got %v", path, files)
+	}
+	if n, err := VerifyAuditLog(path); err != nil || n != 6 {
+		t.Fatalf("expected 6 verified entries, got %d, %v", n, err)
+	}
+}
+
+func TestVerifyAuditLogDetectsTampering(t *testing.T) {
+	cases := []struct {
+		name   string
+		tamper func(lines [][]byte) [][]byte
+	}{
+		{"changed", func(lines [][]byte) [][]byte {
+			lines[1] = bytes.Replace(lines[1], []byte("file.pcap"), []byte("evil.pcap"), 1)
+			return lines
+		}},
+		// Both survive decoding and re-encoding unchanged.
+		{"field injected", func(lines [][]byte) [][]byte {
+			lines[1] = bytes.Replace(lines[1], []byte("{"), []byte(`{"note":"x",`), 1)
+			return lines
+		}},
+		{"duplicate key", func(lines [][]byte) [][]byte {
+			lines[1] = bytes.Replace(lines[1], []byte("{"), []byte(`{"source_filename":"evil.pcap",`), 1)
+			return lines
+		}},
+		{"removed", func(lines [][]byte) [][]byte { return append(lines[:1], lines[2:]...) }},
+		{"oldest removed", func(lines [][]byte) [][]byte { return lines[1:] }},
+		{"reordered", func(lines [][]byte) [][]byte {
+			lines[1], lines[2] = lines[2], lines[1]
+			return lines
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.log")
+			audit, err := newAuditLog(path, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 3; i++ {
+				if err := audit.record(AuditEntry{SourceFilename: "file.pcap", Outcome: AuditSuccess}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := c.tamper(bytes.Split(bytes.TrimSpace(data), []byte("\n")))
+			if err := os.WriteFile(path, append(bytes.Join(lines, []byte("\n")), '\n'), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := VerifyAuditLog(path); !errors.Is(err, ErrAuditChainBroken) {
+				t.Fatalf("expected ErrAuditChainBroken, got %v", err)
+			}
+		})
+	}
+}
+
+func TestSendFileAuditLogDisposition(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	// A file where the archive directory should be.
+	archive := writeTestFile(t, "archive", nil)
+	_, client := testServer(t, Settings{AuditLog: path, Disposition: Disposition{Action: DispositionMove, Dir: archive}})
+	file := writeTestFile(t, "file.pcap", []byte("data"))
+
+	if err := client.SendFile(FileDetails{SourceFilename: file, DestinationFilename: "file.pcap", PayloadType: "pcap"}); err != nil {
+		t.Fatal(err)
+	}
+	entries := readAuditLog(t, path)
+	if len(entries) != 1 || entries[0].Outcome != AuditSuccess || entries[0].ErrorClass != "" || entries[0].DispositionError == "" {
+		t.Fatalf("expected a successful entry with a disposition error, got %+v", entries)
+	}
+}
+
+func TestVerifyAuditLogFromAnchor(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := newAuditLog(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := audit.record(AuditEntry{SourceFilename: "file.pcap", Outcome: AuditSuccess}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := readAuditLog(t, path)[0]
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Archive the first entry away.
+	if err := os.WriteFile(path, data[bytes.IndexByte(data, '\n')+1:], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyAuditLog(path); !errors.Is(err, ErrAuditChainBroken) {
+		t.Fatalf("expected ErrAuditChainBroken without an anchor, got %v", err)
+	}
+	if n, err := VerifyAuditLogFrom(path, AuditAnchor{Seq: first.Seq, Hash: first.Hash}); err != nil || n != 2 {
+		t.Fatalf("expected 2 verified entries, got %d, %v", n, err)
+	}
+}
+
+func TestAuditLogRecoversTornLine(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	audit, err := newAuditLog(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := audit.record(AuditEntry{SourceFilename: "file.pcap", Outcome: AuditSuccess}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The process stopped while writing the third entry.
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torn := []byte(`{"seq":3,"started":"20`)
+	if _, err := file.Write(torn); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	audit, err = newAuditLog(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := audit.record(AuditEntry{SourceFilename: "file.pcap", Outcome: AuditSuccess}); err != nil {
+		t.Fatal(err)
+	}
+	entries := readAuditLog(t, path)
+	if len(entries) != 4 || entries[2].Outcome != AuditRecovered || entries[3].Seq != 4 {
+		t.Fatalf("expected the break to be recorded and the chain to continue, got %+v", entries)
+	}
+	if n, err := VerifyAuditLog(path); err != nil || n != 4 {
+		t.Fatalf("expected 4 verified entries, got %d, %v", n, err)
+	}
+	moved, err := filepath.Glob(path + ".torn-*")
+	if err != nil || len(moved) != 1 {
+		t.Fatalf("expected the torn line to be kept, got %v, %v", moved, err)
+	}
+	if data, _ := os.ReadFile(moved[0]); !bytes.Equal(data, torn) {
+		t.Fatalf("expected %q, got %q", torn, data)
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
 	"os"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
@@ -30,60 +31,140 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func uploadToAzureSAS(filename string, sr sasResult, settings Settings) error {
-	fileHandler, err := os.Open(filename)
-	if err != nil {
-		return err
+// azureStreamBlockSize is the block size for streams, which are buffered a
+// block per concurrent upload.
+const azureStreamBlockSize = 8 * 1024 * 1024
+
+// uploadToAzureSAS uploads c to the blob behind sr.SASURL and returns the
+// token it was finally uploaded with; filename is used in logs. A SAS about
+// to expire is replaced by one from refresh before use, and a SAS rejected by
+// Azure is replaced without using up a try. A stream is only tried once.
+func uploadToAzureSAS(ctx context.Context, httpClient *http.Client, filename string, c *content, sr sasResult, settings Settings, refresh func(context.Context) (sasResult, error)) (sasResult, error) {
+	var fileHandler *os.File
+	if c.path != "" {
+		var err error
+		fileHandler, err = os.Open(c.path)
+		if err != nil {
+			return sr, err
+		}
+		defer fileHandler.Close()
 	}
-	defer fileHandler.Close()
-	stat, err := fileHandler.Stat()
-	if err != nil {
+	fileSize := c.size
+	put := func(client *blockblob.Client) error {
+		var err error
+		switch {
+		case fileHandler != nil:
+			_, err = client.UploadFile(ctx, fileHandler,
+				&azblob.UploadFileOptions{
+					BlockSize:   int64(104857600),
+					Concurrency: uint16(3),
+				})
+		case c.stream != nil:
+			_, err = client.UploadStream(ctx, c.stream,
+				&azblob.UploadStreamOptions{
+					BlockSize:   azureStreamBlockSize,
+					Concurrency: 3,
+				})
+			fileSize = c.stream.n
+		default:
+			_, err = client.UploadBuffer(ctx, c.data,
+				&azblob.UploadBufferOptions{
+					BlockSize:   int64(104857600),
+					Concurrency: uint16(3),
+				})
+		}
 		return err
 	}
-	fileSize := stat.Size()
-	// Do not let the client retry, we need to do it ourselves
-	client, err := blockblob.NewClientWithNoCredential(sr.SASURL, &blockblob.ClientOptions{
-		ClientOptions: policy.ClientOptions{
-			Retry: policy.RetryOptions{
-				MaxRetries: -1,
+	newClient := func(sasURL string) (*blockblob.Client, error) {
+		// Do not let the client retry, we need to do it ourselves
+		return blockblob.NewClientWithNoCredential(sasURL, &blockblob.ClientOptions{
+			ClientOptions: policy.ClientOptions{
+				Retry: policy.RetryOptions{
+					MaxRetries: -1,
+				},
+				Transport: httpClient,
 			},
-		},
-	})
+		})
+	}
+	client, err := newClient(sr.SASURL)
 	if err != nil {
-		return err
+		return sr, err
 	}
 
+	uploadAttempted := false
+	refreshes := 0
+	refreshSAS := func() error {
+		fresh, err := refresh(ctx)
+		if err != nil {
+			return fmt.Errorf("could not refresh SAS for blob_id %v: %v", sr.BlobID, err)
+		}
+		if fresh.Type != "azure" {
+			return fmt.Errorf("refreshed SAS has profile type %v", fresh.Type)
+		}
+		freshClient, err := newClient(fresh.SASURL)
+		if err != nil {
+			return err
+		}
+		if fresh.BlobID != sr.BlobID {
+			uploadAttempted = false
+		}
+		refreshes++
+		sr, client = fresh, freshClient
+		return nil
+	}
+	if expiresSoon(sr.SASURL) {
+		log.Infof("SAS for blob_id %v is about to expire, refreshing", sr.BlobID)
+		if err := refreshSAS(); err != nil {
+			return sr, err
+		}
+	}
 	for retry := 0; retry < settings.MaxRetries; retry++ {
+		if retry > 0 {
+			if err := waitRetry(ctx, settings.RetryBackoff, retry); err != nil {
+				return sr, err
+			}
+		}
 		log.Debugf("Try %v of %v", retry+1, settings.MaxRetries)
 		// Check if the blob exists by getting its properties
-		_, err = client.GetProperties(context.TODO(), nil)
+		properties, err := client.GetProperties(ctx, nil)
 		if err != nil {
-			log.Debugf("Properties error: %v", err)
+			log.Debugf("Properties error: %v", redactError(err))
 			var storageErr *azcore.ResponseError
 			if errors.As(err, &storageErr) && storageErr.ErrorCode == "BlobNotFound" {
 				// Upload the file since it was not found
-				_, err = client.UploadFile(context.TODO(), fileHandler,
-					&azblob.UploadFileOptions{
-						BlockSize:   int64(104857600),
-						Concurrency: uint16(3),
-					})
+				uploadAttempted = true
+				err = put(client)
+				if err != nil && c.stream != nil {
+					return sr, fmt.Errorf("failed to upload stream, blob_id %v: %v", sr.BlobID, redactError(err))
+				}
 				if err != nil {
-					log.Errorf("failed to upload file: %v, blob_id %v. Try %v of %v", err, sr.BlobID, retry+1, settings.MaxRetries)
+					log.Errorf("failed to upload file: %v, blob_id %v. Try %v of %v", redactError(err), sr.BlobID, retry+1, settings.MaxRetries)
 				} else {
 					if settings.Debug {
-						log.Debugf("Uploaded file %v, blob_id %v to %v, total %v. Try %v of %v", filename, sr.BlobID, sr.SASURL, bytesize.ByteSize(fileSize).String(), retry+1, settings.MaxRetries)
+						log.Debugf("Uploaded file %v, blob_id %v to %v, total %v. Try %v of %v", filename, sr.BlobID, RedactURL(sr.SASURL), bytesize.ByteSize(fileSize).String(), retry+1, settings.MaxRetries)
 					} else {
 						log.Infof("Uploaded file %v, blob_id %v, total %v. Try %v of %v", filename, sr.BlobID, bytesize.ByteSize(fileSize).String(), retry+1, settings.MaxRetries)
 					}
-					return nil
+					return sr, nil
 				}
 			} else {
-				log.Errorf("failed to get blob properties: %v, blob_id %v. Try %v of %v", err, sr.BlobID, retry+1, settings.MaxRetries)
+				log.Errorf("failed to get blob properties: %v, blob_id %v. Try %v of %v", redactError(err), sr.BlobID, retry+1, settings.MaxRetries)
+			}
+			if isExpiredAzureError(err) && refreshes < maxSignatureRefreshes {
+				log.Warnf("SAS for blob_id %v was rejected, refreshing", sr.BlobID)
+				if err := refreshSAS(); err != nil {
+					return sr, err
+				}
+				retry--
 			}
+		} else if uploadAttempted && properties.ContentLength != nil && *properties.ContentLength == fileSize {
+			// An earlier try stored the blob but its response was lost
+			log.Infof("Uploaded file %v, blob_id %v, total %v. Confirmed on try %v of %v", filename, sr.BlobID, bytesize.ByteSize(fileSize).String(), retry+1, settings.MaxRetries)
+			return sr, nil
 		} else {
 			// The client should not retry if the blob already exists
-			return ErrFileExists
+			return sr, ErrFileExists
 		}
 	}
-	return fmt.Errorf("failed to send payload after %v retries", maxRetry)
+	return sr, fmt.Errorf("failed to send payload after %v retries", settings.MaxRetries)
 }
@@ -0,0 +1,57 @@
+package transmitter
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/SamuraiMDR/samurai-go/pkg/transmitter/transmittertest"
+)
+
+func TestSendFileAzureRetriesTransientFaults(t *testing.T) {
+	cases := []struct {
+		name  string
+		fault transmittertest.TransportFault
+	}{
+		{"dropped connection", transmittertest.TransportFault{Drop: true}},
+		{"server busy", transmittertest.TransportFault{StatusCode: http.StatusServiceUnavailable}},
+		// The blob is stored but the response is lost, so the retry finds it.
+		{"lost response", transmittertest.TransportFault{DropResponse: true}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			transport := &transmittertest.FaultTransport{
+				Match:  transmittertest.MatchRequest(http.MethodPut, "/blob/"),
+				Script: []transmittertest.TransportFault{c.fault},
+			}
+			server, client := testServer(t, Settings{Profile: "azure", Transport: transport})
+			data := []byte("azure data")
+
+			err := client.SendFile(FileDetails{SourceFilename: writeTestFile(t, "file.json", data), DestinationFilename: "file.json", PayloadType: "bouncer"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			object, ok := server.Object("bouncer/file.json")
+			if !ok || !bytes.Equal(object.Data, data) || transport.Faults() != 1 {
+				t.Fatalf("expected stored blob after one fault, got %q after %d faults", object.Data, transport.Faults())
+			}
+		})
+	}
+}
+
+func TestSendFileAzureExistingBlob(t *testing.T) {
+	server, client := testServer(t, Settings{Profile: "azure"})
+	path := writeTestFile(t, "file.json", []byte("{}"))
+	fd := FileDetails{SourceFilename: path, DestinationFilename: "file.json", PayloadType: "bouncer"}
+
+	if err := client.SendFile(fd); err != nil {
+		t.Fatal(err)
+	}
+	// The mock issues a fresh upload for the same name, but the blob exists.
+	if err := client.SendFile(fd); err != ErrFileExists {
+		t.Fatalf("expected ErrFileExists, got %v", err)
+	}
+	if len(server.Objects()) != 1 {
+		t.Fatalf("expected one object, got %d", len(server.Objects()))
+	}
+}
@@ -0,0 +1,163 @@
+/*
+ * NTT Security Holdings Go Library for Samurai
+ * Copyright 2023 NTT Security Holdings
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package transmitter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/inhies/go-bytesize"
+)
+
+// Payload types known to the service.
+const (
+	PayloadPcap    = "pcap"
+	PayloadBouncer = "bouncer"
+	PayloadLogs    = "logs"
+)
+
+var ErrSuffixNotAllowed = errors.New("file suffix not allowed for payload type")
+var ErrPayloadTooLarge = errors.New("file too large for payload type")
+
+// PayloadType describes what the service accepts for one payload type. An
+// empty Suffixes list allows any suffix and a zero MaxSize any size.
+type PayloadType struct {
+	Name     string   `json:"name"`
+	Suffixes []string `json:"suffixes"`
+	MaxSize  int64    `json:"max_size"`
+}
+
+// Catalog holds the payload types checked before a token is requested.
+// Types that are not in the catalog are passed on to the service unless
+// Strict is set, in which case they fail with ErrUnknownPayload. A Catalog is
+// safe for concurrent use, including Refresh while uploads are running.
+type Catalog struct {
+	Strict bool
+
+	mu    sync.RWMutex
+	types map[string]PayloadType
+}
+
+// CatalogFetcher returns the payload types currently accepted, for example
+// from a configuration endpoint.
+type CatalogFetcher func(ctx context.Context) ([]PayloadType, error)
+
+// NewCatalog returns a catalog holding types.
+func NewCatalog(types ...PayloadType) *Catalog {
+	c := &Catalog{}
+	c.set(types)
+	return c
+}
+
+// DefaultCatalog returns a catalog of the payload types built into this
+// library. It is not enforced unless set as Settings.Catalog; the service
+// remains the authority on what it accepts.
+func DefaultCatalog() *Catalog {
+	return NewCatalog(
+		PayloadType{Name: PayloadPcap, Suffixes: []string{"pcap", "pcapng"}, MaxSize: 10 * int64(bytesize.GB)},
+		PayloadType{Name: PayloadBouncer, Suffixes: []string{"json", "ndjson", "jsonl"}, MaxSize: 100 * int64(bytesize.MB)},
+		PayloadType{Name: PayloadLogs, Suffixes: []string{"log", "txt", "json", "ndjson", "jsonl", "gz"}, MaxSize: 5 * int64(bytesize.GB)},
+	)
+}
+
+// ParseCatalog reads a JSON list of payload types.
+func ParseCatalog(data []byte) (*Catalog, error) {
+	var types []PayloadType
+	if err := json.Unmarshal(data, &types); err != nil {
+		return nil, fmt.Errorf("could not parse payload catalog: %v", err)
+	}
+	return NewCatalog(types...), nil
+}
+
+func (c *Catalog) set(types []PayloadType) {
+	byName := make(map[string]PayloadType, len(types))
+	for _, t := range types {
+		byName[t.Name] = t
+	}
+	c.mu.Lock()
+	c.types = byName
+	c.mu.Unlock()
+}
+
+// Refresh replaces the catalog content with the types returned by fetch. On
+// error the current content is kept.
+func (c *Catalog) Refresh(ctx context.Context, fetch CatalogFetcher) error {
+	types, err := fetch(ctx)
+	if err != nil {
+		return err
+	}
+	c.set(types)
+	return nil
+}
+
+// Lookup returns the payload type with the given name. A nil catalog holds
+// no types.
+func (c *Catalog) Lookup(name string) (PayloadType, bool) {
+	if c == nil {
+		return PayloadType{}, false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	t, ok := c.types[name]
+	return t, ok
+}
+
+// Types returns the payload types sorted by name.
+func (c *Catalog) Types() []PayloadType {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	types := make([]PayloadType, 0, len(c.types))
+	for _, t := range c.types {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i].Name < types[j].Name })
+	return types
+}
+
+// Check reports whether a file with the given suffix and size can be sent as
+// payload. The errors wrap ErrUnknownPayload, ErrSuffixNotAllowed or
+// ErrPayloadTooLarge. A nil catalog allows everything.
+func (c *Catalog) Check(payload string, suffix string, size int64) error {
+	if c == nil {
+		return nil
+	}
+	t, ok := c.Lookup(payload)
+	if !ok {
+		if c.Strict {
+			return fmt.Errorf("payload %q: %w", payload, ErrUnknownPayload)
+		}
+		return nil
+	}
+	if len(t.Suffixes) > 0 {
+		allowed := false
+		for _, s := range t.Suffixes {
+			allowed = allowed || strings.EqualFold(s, suffix)
+		}
+		if !allowed {
+			return fmt.Errorf("suffix %q for payload %q, expected one of %v: %w", suffix, payload, t.Suffixes, ErrSuffixNotAllowed)
+		}
+	}
+	if t.MaxSize > 0 && size > t.MaxSize {
+		return fmt.Errorf("%v for payload %q, max %v: %w", bytesize.ByteSize(size), payload, bytesize.ByteSize(t.MaxSize), ErrPayloadTooLarge)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package transmitter
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/SamuraiMDR/samurai-go/pkg/transmitter/transmittertest"
+)
+
+func TestCatalogCheck(t *testing.T) {
+	catalog := NewCatalog(PayloadType{Name: "pcap", Suffixes: []string{"pcap", "pcapng"}, MaxSize: 100})
+	cases := []struct {
+		name    string
+		strict  bool
+		payload string
+		suffix  string
+		size    int64
+		wantErr error
+	}{
+		{"known payload", false, "pcap", "pcap", 10, nil},
+		{"suffix case insensitive", false, "pcap", "PCAPNG", 10, nil},
+		{"wrong suffix", false, "pcap", "json", 10, ErrSuffixNotAllowed},
+		{"too large", false, "pcap", "pcap", 101, ErrPayloadTooLarge},
+		{"unknown payload", false, "custom", "bin", 1000, nil},
+		{"unknown payload strict", true, "custom", "bin", 1000, ErrUnknownPayload},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			catalog.Strict = c.strict
+			err := catalog.Check(c.payload, c.suffix, c.size)
+			if !errors.Is(err, c.wantErr) || (err == nil) != (c.wantErr == nil) {
+				t.Fatalf("Check(%q, %q, %d) error = %v, want %v", c.payload, c.suffix, c.size, err, c.wantErr)
+			}
+		})
+	}
+}
+
+func TestCatalogRefresh(t *testing.T) {
+	catalog, err := ParseCatalog([]byte(`[{"name":"logs","suffixes":["log"],"max_size":10}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := catalog.Lookup("logs"); !ok {
+		t.Fatal("expected logs in parsed catalog")
+	}
+
+	failing := func(ctx context.Context) ([]PayloadType, error) { return nil, errors.New("unavailable") }
+	if err := catalog.Refresh(context.Background(), failing); err == nil {
+		t.Fatal("expected refresh error")
+	}
+	if len(catalog.Types()) != 1 {
+		t.Fatal("failed refresh must keep the catalog")
+	}
+
+	fetch := func(ctx context.Context) ([]PayloadType, error) {
+		return []PayloadType{{Name: "pcap"}, {Name: "bouncer"}}, nil
+	}
+	if err := catalog.Refresh(context.Background(), fetch); err != nil {
+		t.Fatal(err)
+	}
+	types := catalog.Types()
+	if len(types) != 2 || types[0].Name != "bouncer" || types[1].Name != "pcap" {
+		t.Fatalf("unexpected types after refresh: %+v", types)
+	}
+}
+
+func TestSendFileCatalogMismatch(t *testing.T) {
+	cases := []struct {
+		name     string
+		catalog  *Catalog
+		err      error
+		requests int
+	}{
+		{"catalog", DefaultCatalog(), ErrSuffixNotAllowed, 0},
+		// Without a catalog the service decides.
+		{"no catalog", nil, nil, 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			server, client := testServer(t, Settings{Catalog: c.catalog})
+			path := writeTestFile(t, "alert.txt", []byte("{}"))
+			_, err := client.SendFileContext(context.Background(), FileDetails{SourceFilename: path, PayloadType: PayloadBouncer})
+			if !errors.Is(err, c.err) {
+				t.Fatalf("expected %v, got %v", c.err, err)
+			}
+			if server.Requests(transmittertest.OpToken) != c.requests {
+				t.Fatalf("expected %d token requests, got %d", c.requests, server.Requests(transmittertest.OpToken))
+			}
+		})
+	}
+}
+
+func TestDefaultCatalogMatchesValidators(t *testing.T) {
+	// Every suffix a built-in validator handles for a payload is allowed.
+	cases := []struct {
+		payload string
+		suffix  string
+	}{
+		{PayloadPcap, "pcap"},
+		{PayloadPcap, "pcapng"},
+		{PayloadBouncer, "json"},
+		{PayloadBouncer, "ndjson"},
+		{PayloadBouncer, "jsonl"},
+		{PayloadLogs, "ndjson"},
+		{PayloadLogs, "jsonl"},
+	}
+	catalog := DefaultCatalog()
+	for _, c := range cases {
+		if err := catalog.Check(c.payload, c.suffix, 1); err != nil {
+			t.Errorf("Check(%q, %q) = %v", c.payload, c.suffix, err)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+/*
+ * NTT Security Holdings Go Library for Samurai
+ * Copyright 2023 NTT Security Holdings
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package transmitter
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// content is what an upload sends: a file, a byte slice or a stream. Files
+// and byte slices can be read more than once, so they are measured and
+// validated before the upload and retried as a whole; a stream is read once
+// and measured while it is sent.
+type content struct {
+	path   string
+	data   []byte
+	stream *streamReader
+	// size is -1 for a stream of unknown length.
+	size   int64
+	sha256 string
+}
+
+func fileContent(path string) *content {
+	return &content{path: path}
+}
+
+func bytesContent(data []byte) *content {
+	return &content{data: data, size: int64(len(data))}
+}
+
+// streamContent reads exactly size bytes from r, or all of r when size is
+// negative.
+func streamContent(r io.Reader, size int64) *content {
+	stream := &streamReader{r: r, hash: sha256.New(), expected: -1}
+	if size >= 0 {
+		stream.r = io.LimitReader(r, size)
+		stream.expected = size
+	} else {
+		size = -1
+	}
+	return &content{stream: stream, size: size}
+}
+
+// measure computes the size and checksum of files and byte slices.
+func (c *content) measure() error {
+	switch {
+	case c.path != "":
+		size, checksum, err := fileChecksum(c.path)
+		if err != nil {
+			return err
+		}
+		c.size, c.sha256 = size, checksum
+	case c.stream == nil:
+		sum := sha256.Sum256(c.data)
+		c.sha256 = hex.EncodeToString(sum[:])
+	}
+	return nil
+}
+
+// readerAt opens files and byte slices for random access. It returns nil for
+// streams.
+func (c *content) readerAt() (io.ReaderAt, func(), error) {
+	switch {
+	case c.path != "":
+		file, err := os.Open(c.path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return file, func() { file.Close() }, nil
+	case c.stream == nil:
+		return bytes.NewReader(c.data), func() {}, nil
+	}
+	return nil, func() {}, nil
+}
+
+// reader returns the content from the start. For streams it can only be
+// called once.
+func (c *content) reader() (io.Reader, func(), error) {
+	if c.stream != nil {
+		return c.stream, func() {}, nil
+	}
+	r, closer, err := c.readerAt()
+	if err != nil {
+		return nil, nil, err
+	}
+	return io.NewSectionReader(r, 0, c.size), closer, nil
+}
+
+// drain reads the rest of a stream so that its size and checksum are known.
+func (c *content) drain() error {
+	if c.stream == nil {
+		return nil
+	}
+	_, err := io.Copy(io.Discard, c.stream)
+	return err
+}
+
+// update fills in the size and checksum of a stream that has been read.
+func (c *content) update(upload *UploadResult) {
+	if c.stream == nil {
+		return
+	}
+	upload.Size = c.stream.n
+	upload.SHA256 = hex.EncodeToString(c.stream.hash.Sum(nil))
+	upload.Parts = partCount(c.stream.n)
+}
+
+// streamReader hashes and counts a stream as it is read. It fails when the
+// stream grows beyond limit or ends before expected bytes.
+type streamReader struct {
+	r        io.Reader
+	hash     hash.Hash
+	n        int64
+	limit    int64
+	expected int64
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.hash.Write(p[:n])
+	s.n += int64(n)
+	if s.limit > 0 && s.n > s.limit {
+		return n, fmt.Errorf("stream exceeds %v bytes: %w", s.limit, ErrPayloadTooLarge)
+	}
+	if err == io.EOF && s.expected >= 0 && s.n < s.expected {
+		return n, fmt.Errorf("stream ended after %v of %v bytes: %w", s.n, s.expected, io.ErrUnexpectedEOF)
+	}
+	return n, err
+}
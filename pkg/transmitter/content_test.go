@@ -0,0 +1,111 @@
+package transmitter
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"testing"
+)
+
+// onlyReader hides every method but Read, like a pipe.
+type onlyReader struct{ r io.Reader }
+
+func (o onlyReader) Read(p []byte) (int, error) { return o.r.Read(p) }
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestSendBytesAndReader(t *testing.T) {
+	withPartSize(t, 4)
+	data := []byte("0123456789")
+	cases := []struct {
+		name    string
+		profile string
+		send    func(client Client, fd FileDetails) (UploadResult, error)
+	}{
+		{"bytes s3", "s3", func(client Client, fd FileDetails) (UploadResult, error) {
+			return client.SendBytesContext(context.Background(), data, fd)
+		}},
+		{"bytes azure", "azure", func(client Client, fd FileDetails) (UploadResult, error) {
+			return client.SendBytesContext(context.Background(), data, fd)
+		}},
+		{"reader s3", "s3", func(client Client, fd FileDetails) (UploadResult, error) {
+			return client.SendReaderContext(context.Background(), onlyReader{bytes.NewReader(data)}, int64(len(data)), fd)
+		}},
+		{"unknown length s3", "s3", func(client Client, fd FileDetails) (UploadResult, error) {
+			return client.SendReaderContext(context.Background(), onlyReader{bytes.NewReader(data)}, -1, fd)
+		}},
+		{"unknown length azure", "azure", func(client Client, fd FileDetails) (UploadResult, error) {
+			return client.SendReaderContext(context.Background(), onlyReader{bytes.NewReader(data)}, -1, fd)
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			server, client := testServer(t, Settings{Profile: c.profile})
+			upload, err := c.send(client, FileDetails{SourceFilename: "generated", FileSuffix: "log", DestinationFilename: "out.log", PayloadType: "logs"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			object, ok := server.Object("logs/out.log")
+			if !ok || !bytes.Equal(object.Data, data) {
+				t.Fatalf("expected stored object, got %q", object.Data)
+			}
+			if upload.Size != int64(len(data)) || upload.SHA256 != sha256Hex(data) || upload.Parts != 3 {
+				t.Fatalf("unexpected result %+v", upload)
+			}
+		})
+	}
+}
+
+func TestSendReaderEmptyStream(t *testing.T) {
+	server, client := testServer(t, Settings{})
+	if err := client.SendReader(onlyReader{bytes.NewReader(nil)}, -1, FileDetails{FileSuffix: "log", DestinationFilename: "empty.log", PayloadType: "logs"}); err != nil {
+		t.Fatal(err)
+	}
+	if object, ok := server.Object("logs/empty.log"); !ok || len(object.Data) != 0 {
+		t.Fatalf("expected empty object, got %v", object)
+	}
+}
+
+func TestSendReaderErrors(t *testing.T) {
+	withPartSize(t, 4)
+	cases := []struct {
+		name    string
+		size    int64
+		data    string
+		wantErr error
+	}{
+		{"short stream", 7, "012345", io.ErrUnexpectedEOF},
+		{"too large", -1, "0123456789", ErrPayloadTooLarge},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			catalog := NewCatalog(PayloadType{Name: "logs", MaxSize: 8})
+			server, client := testServer(t, Settings{Catalog: catalog})
+			err := client.SendReader(onlyReader{bytes.NewReader([]byte(c.data))}, c.size, FileDetails{FileSuffix: "log", PayloadType: "logs"})
+			if !errors.Is(err, c.wantErr) {
+				t.Fatalf("expected %v, got %v", c.wantErr, err)
+			}
+			if len(server.Aborted()) != 1 || len(server.Objects()) != 0 {
+				t.Fatalf("expected the upload to be aborted, aborted %v", server.Aborted())
+			}
+		})
+	}
+}
+
+func TestSendReaderDryRun(t *testing.T) {
+	data := []byte("streamed")
+	_, client := testServer(t, Settings{DryRun: true})
+	upload, err := client.SendReaderContext(context.Background(), onlyReader{bytes.NewReader(data)}, -1, FileDetails{FileSuffix: "log", PayloadType: "logs"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upload.Size != int64(len(data)) || upload.SHA256 != sha256Hex(data) || !upload.DryRun {
+		t.Fatalf("unexpected plan %+v", upload)
+	}
+}
@@ -0,0 +1,145 @@
+/*
+ * NTT Security Holdings Go Library for Samurai
+ * Copyright 2023 NTT Security Holdings
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package transmitter
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/SamuraiMDR/samurai-go/pkg/credentials"
+	"github.com/google/uuid"
+)
+
+var ErrInvalidDestination = errors.New("invalid destination filename")
+
+// DestinationData is available to destination filename templates, for
+// example:
+//
+//	{{.Hostname}}/{{.Date "2006/01/02"}}/{{.SHA256}}.{{.Suffix}}
+type DestinationData struct {
+	DeviceId      string
+	IntegrationId string
+	Hostname      string
+	PayloadType   string
+	// Source is the base name of the source file.
+	Source string
+	Suffix string
+	// Time is when the upload started, in UTC.
+	Time time.Time
+	UUID string
+
+	sha256 string
+}
+
+// Date formats Time with layout.
+func (d DestinationData) Date(layout string) string {
+	return d.Time.Format(layout)
+}
+
+// Unix returns Time in seconds since the epoch.
+func (d DestinationData) Unix() int64 {
+	return d.Time.Unix()
+}
+
+// SHA256 returns the hex encoded checksum of the source content, before any
+// Transformers. It is not known before a stream is read, so templates using
+// it fail for SendReader.
+func (d DestinationData) SHA256() (string, error) {
+	if d.sha256 == "" {
+		return "", fmt.Errorf("checksum of a stream is not known before upload")
+	}
+	return d.sha256, nil
+}
+
+// isTemplate reports whether a destination filename uses template syntax.
+func isTemplate(name string) bool {
+	return strings.Contains(name, "{{")
+}
+
+// parseDestinationTemplate parses a destination filename template. Missing
+// keys are errors.
+func parseDestinationTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("destination").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", err, ErrInvalidDestination)
+	}
+	return tmpl, nil
+}
+
+// renderDestination executes tmpl and checks that the result is a relative
+// path without empty or parent segments.
+func renderDestination(tmpl *template.Template, data DestinationData) (string, error) {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("%v: %w", err, ErrInvalidDestination)
+	}
+	name := b.String()
+	if name == "" || strings.HasPrefix(name, "/") || strings.Contains(name, "\\") {
+		return "", fmt.Errorf("%q: %w", name, ErrInvalidDestination)
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", fmt.Errorf("%q: %w", name, ErrInvalidDestination)
+		}
+	}
+	return name, nil
+}
+
+// destination returns the destination filename for fd: its template or
+// literal DestinationFilename, or else Settings.DestinationTemplate. creds is
+// only called when a template is rendered.
+func (client Client) destination(fd FileDetails, c *content, suffix string, creds func() (credentials.APICredentials, error)) (string, error) {
+	tmpl := client.destinationTemplate
+	if fd.DestinationFilename != "" {
+		if !isTemplate(fd.DestinationFilename) {
+			return fd.DestinationFilename, nil
+		}
+		var err error
+		if tmpl, err = parseDestinationTemplate(fd.DestinationFilename); err != nil {
+			return "", err
+		}
+	}
+	if tmpl == nil {
+		return "", nil
+	}
+	cred, err := creds()
+	if err != nil {
+		return "", err
+	}
+	hostname, _ := os.Hostname()
+	source := ""
+	if fd.SourceFilename != "" {
+		source = filepath.Base(fd.SourceFilename)
+	}
+	data := DestinationData{
+		DeviceId:      cred.DeviceId,
+		IntegrationId: cred.IntegrationId,
+		Hostname:      hostname,
+		PayloadType:   fd.PayloadType,
+		Source:        source,
+		Suffix:        suffix,
+		Time:          time.Now().UTC(),
+		UUID:          uuid.NewString(),
+		sha256:        c.sha256,
+	}
+	return renderDestination(tmpl, data)
+}
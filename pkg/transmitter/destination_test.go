@@ -0,0 +1,100 @@
+package transmitter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SamuraiMDR/samurai-go/pkg/credentials"
+)
+
+func TestRenderDestination(t *testing.T) {
+	data := DestinationData{
+		DeviceId:    "device",
+		PayloadType: "pcap",
+		Source:      "capture.pcap",
+		Suffix:      "pcap",
+		Time:        time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC),
+		UUID:        "uuid",
+		sha256:      "abc",
+	}
+	cases := []struct {
+		template string
+		expected string
+		err      error
+	}{
+		{`{{.DeviceId}}/{{.Date "2006/01/02"}}/{{.SHA256}}.{{.Suffix}}`, "device/2024/05/06/abc.pcap", nil},
+		{`{{.PayloadType}}-{{.Unix}}-{{.UUID}}-{{.Source}}`, "pcap-1714979289-uuid-capture.pcap", nil},
+		{`{{.Missing}}`, "", ErrInvalidDestination},
+		{`/{{.Source}}`, "", ErrInvalidDestination},
+		{`a/../{{.Source}}`, "", ErrInvalidDestination},
+		{`a//{{.Source}}`, "", ErrInvalidDestination},
+		{`{{.IntegrationId}}`, "", ErrInvalidDestination},
+		{`a\{{.Source}}`, "", ErrInvalidDestination},
+	}
+	for _, c := range cases {
+		t.Run(c.template, func(t *testing.T) {
+			tmpl, err := parseDestinationTemplate(c.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			name, err := renderDestination(tmpl, data)
+			if !errors.Is(err, c.err) || name != c.expected {
+				t.Fatalf("expected %q, %v, got %q, %v", c.expected, c.err, name, err)
+			}
+		})
+	}
+}
+
+func TestSendFileDestinationTemplate(t *testing.T) {
+	server, client := testServer(t, Settings{DestinationTemplate: `{{.PayloadType}}-{{.SHA256}}.{{.Suffix}}`})
+	data := []byte("data")
+	path := writeTestFile(t, "file.pcap", data)
+
+	upload, err := client.SendFileContext(context.Background(), FileDetails{SourceFilename: path, PayloadType: "pcap"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "pcap-" + sha256Hex(data) + ".pcap"
+	if upload.DestinationFilename != expected {
+		t.Fatalf("expected destination %q, got %q", expected, upload.DestinationFilename)
+	}
+	object, ok := server.Object("pcap/" + expected)
+	if !ok || !bytes.Equal(object.Data, data) {
+		t.Fatalf("expected object pcap/%s, got %v", expected, server.Objects())
+	}
+
+	// A template in FileDetails overrides the setting, a literal is kept.
+	for _, name := range []string{`{{.Source}}.copy`, "literal.pcap"} {
+		upload, err := client.SendFileContext(context.Background(), FileDetails{SourceFilename: path, DestinationFilename: name, PayloadType: "pcap"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := strings.ReplaceAll(name, "{{.Source}}", "file.pcap")
+		if _, ok := server.Object("pcap/" + expected); !ok || upload.DestinationFilename != expected {
+			t.Fatalf("expected object pcap/%s, got %q", expected, upload.DestinationFilename)
+		}
+	}
+}
+
+func TestSendReaderDestinationTemplateChecksum(t *testing.T) {
+	server, client := testServer(t, Settings{DestinationTemplate: `{{.SHA256}}.{{.Suffix}}`})
+
+	_, err := client.SendReaderContext(context.Background(), strings.NewReader("data"), -1, FileDetails{FileSuffix: "log", PayloadType: "logs"})
+	if !errors.Is(err, ErrInvalidDestination) {
+		t.Fatalf("expected ErrInvalidDestination, got %v", err)
+	}
+	if len(server.Objects()) != 0 {
+		t.Fatalf("expected no objects, got %d", len(server.Objects()))
+	}
+}
+
+func TestNewClientInvalidDestinationTemplate(t *testing.T) {
+	_, err := NewClient(Settings{DestinationTemplate: "{{.Source"}, credentials.APICredentials{URL: "https://host.invalid", APIKey: "key", Passkey: "pass", DeviceId: "device"})
+	if !errors.Is(err, ErrInvalidDestination) {
+		t.Fatalf("expected ErrInvalidDestination, got %v", err)
+	}
+}
@@ -0,0 +1,266 @@
+/*
+ * NTT Security Holdings Go Library for Samurai
+ * Copyright 2023 NTT Security Holdings
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package transmitter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Source file dispositions applied after a successful upload.
+const (
+	DispositionKeep   = "keep"
+	DispositionDelete = "delete"
+	DispositionMove   = "move"
+	DispositionRename = "rename"
+)
+
+// defaultRenameSuffix is appended by DispositionRename without a Suffix.
+const defaultRenameSuffix = ".sent"
+
+// ErrDisposition is wrapped by UploadResult.DispositionError when a source
+// file was uploaded but could not be disposed of.
+var ErrDisposition = errors.New("source file disposition failed")
+
+// Disposition says what happens to a source file once its upload is
+// confirmed. Nothing happens in a dry run, on failure, or to bytes and
+// readers.
+type Disposition struct {
+	// Action is DispositionKeep (default), DispositionDelete,
+	// DispositionMove or DispositionRename.
+	Action string `yaml:"action" json:"action,omitempty"`
+	// Dir receives the file for DispositionMove.
+	Dir string `yaml:"dir" json:"dir,omitempty"`
+	// Suffix is appended for DispositionRename, default ".sent".
+	Suffix string `yaml:"suffix" json:"suffix,omitempty"`
+}
+
+func (d Disposition) validate() error {
+	switch d.Action {
+	case "", DispositionKeep, DispositionDelete, DispositionRename:
+		return nil
+	case DispositionMove:
+		if d.Dir == "" {
+			return fmt.Errorf("disposition %q requires a directory", d.Action)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown disposition %q", d.Action)
+}
+
+// apply disposes of path and returns where it now is, or "" when it was
+// deleted. Existing files are never overwritten; a moved or renamed file
+// gets a numbered name instead.
+func (d Disposition) apply(path string) (string, error) {
+	switch d.Action {
+	case "", DispositionKeep:
+		return path, nil
+	case DispositionDelete:
+		if err := os.Remove(path); err != nil {
+			return path, err
+		}
+		return "", nil
+	case DispositionMove:
+		if err := os.MkdirAll(d.Dir, 0700); err != nil {
+			return path, err
+		}
+		return archiveFile(path, filepath.Join(d.Dir, filepath.Base(path)))
+	case DispositionRename:
+		suffix := d.Suffix
+		if suffix == "" {
+			suffix = defaultRenameSuffix
+		}
+		return archiveFile(path, path+suffix)
+	}
+	return path, fmt.Errorf("unknown disposition %q", d.Action)
+}
+
+// archiveFile moves path to target like moveFile and sets its modification
+// time to now. Retention ages archived files from when they were archived,
+// while a link or rename keeps the time the source was written.
+func archiveFile(path string, target string) (string, error) {
+	moved, err := moveFile(path, target)
+	if err != nil {
+		return moved, err
+	}
+	now := time.Now()
+	return moved, os.Chtimes(moved, now, now)
+}
+
+// moveFile moves path to target, or to target.1, target.2, ... when target
+// exists. Across file systems the file is copied to a new file created with
+// O_EXCL and synced before path is removed. Neither way overwrites a file
+// that appears concurrently.
+func moveFile(path string, target string) (string, error) {
+	for i := 0; ; i++ {
+		name := numberedName(target, i)
+		// A hard link fails if name exists, so nothing is overwritten.
+		err := os.Link(path, name)
+		if err == nil {
+			return name, os.Remove(path)
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return copyFile(path, target)
+		}
+	}
+}
+
+// copyFile copies path to the first free numbered name of target and
+// removes path.
+func copyFile(path string, target string) (string, error) {
+	source, err := os.Open(path)
+	if err != nil {
+		return target, err
+	}
+	defer source.Close()
+	var file *os.File
+	var name string
+	for i := 0; ; i++ {
+		name = numberedName(target, i)
+		file, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return name, err
+		}
+	}
+	_, err = io.Copy(file, source)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(name)
+		return name, err
+	}
+	return name, os.Remove(path)
+}
+
+func numberedName(target string, i int) string {
+	if i == 0 {
+		return target
+	}
+	return target + "." + strconv.Itoa(i)
+}
+
+// dispose applies the disposition for fd to the uploaded source file. A
+// failure is reported in upload.DispositionError, the upload itself stands.
+func (client Client) dispose(fd FileDetails, upload *UploadResult) {
+	disposition := client.settings.Disposition
+	if fd.Disposition != nil {
+		disposition = *fd.Disposition
+	}
+	if upload.DryRun || disposition.Action == "" || disposition.Action == DispositionKeep {
+		return
+	}
+	disposed, err := disposition.apply(fd.SourceFilename)
+	if err != nil {
+		log.Errorf("Uploaded file %v could not be disposed of (%v): %v", fd.SourceFilename, disposition.Action, err)
+		upload.DispositionError = fmt.Errorf("%w: %v", ErrDisposition, err)
+		return
+	}
+	log.Debugf("Uploaded file %v disposed of (%v)", fd.SourceFilename, disposition.Action)
+	upload.DisposedFilename = disposed
+}
+
+// Retention limits the files kept in an archive directory. Zero values
+// disable a limit.
+type Retention struct {
+	// MaxAgeDays removes files modified, which for disposed files is when
+	// they were archived, more than this many days ago.
+	MaxAgeDays int `yaml:"max_age_days"`
+	// MaxBytes removes the oldest files until the rest fit.
+	MaxBytes int64 `yaml:"max_bytes"`
+}
+
+// Sweep removes regular files in dir whose names end in suffix (any name
+// when empty) that are older than MaxAgeDays, then the oldest ones until the
+// rest take up at most MaxBytes. It returns the removed paths.
+func (r Retention) Sweep(dir string, suffix string) ([]string, error) {
+	return r.sweep(dir, suffix, time.Now())
+}
+
+func (r Retention) sweep(dir string, suffix string, now time.Time) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type archived struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var files []archived
+	var total int64
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !strings.HasSuffix(entry.Name(), suffix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, archived{filepath.Join(dir, entry.Name()), info.Size(), info.ModTime()})
+		total += info.Size()
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+
+	var removed []string
+	var errs []error
+	cutoff := now.AddDate(0, 0, -r.MaxAgeDays)
+	for _, file := range files {
+		expired := r.MaxAgeDays > 0 && file.modTime.Before(cutoff)
+		overQuota := r.MaxBytes > 0 && total > r.MaxBytes
+		if !expired && !overQuota {
+			continue
+		}
+		if err := os.Remove(file.path); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		total -= file.size
+		removed = append(removed, file.path)
+	}
+	return removed, errors.Join(errs...)
+}
+
+// SweepArchive applies Settings.Retention to the directory of a
+// DispositionMove setting. Files renamed in place by DispositionRename are
+// swept with Retention.Sweep on their directory and suffix.
+func (client Client) SweepArchive() ([]string, error) {
+	disposition := client.settings.Disposition
+	if disposition.Action != DispositionMove {
+		return nil, fmt.Errorf("no archive directory, disposition is %q", disposition.Action)
+	}
+	removed, err := client.settings.Retention.Sweep(disposition.Dir, "")
+	if len(removed) > 0 {
+		log.Infof("Removed %d archived files from %v", len(removed), disposition.Dir)
+	}
+	return removed, err
+}
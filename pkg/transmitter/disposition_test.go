@@ -0,0 +1,228 @@
+package transmitter
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/SamuraiMDR/samurai-go/pkg/transmitter/transmittertest"
+)
+
+func TestSendFileDisposition(t *testing.T) {
+	archive := t.TempDir()
+	cases := []struct {
+		name        string
+		disposition Disposition
+		expected    func(path string) string
+	}{
+		{"keep", Disposition{}, func(path string) string { return path }},
+		{"delete", Disposition{Action: DispositionDelete}, func(string) string { return "" }},
+		{"move", Disposition{Action: DispositionMove, Dir: archive}, func(path string) string { return filepath.Join(archive, "file.pcap") }},
+		{"rename", Disposition{Action: DispositionRename}, func(path string) string { return path + ".sent" }},
+		{"rename suffix", Disposition{Action: DispositionRename, Suffix: ".done"}, func(path string) string { return path + ".done" }},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, client := testServer(t, Settings{Disposition: c.disposition})
+			path := writeTestFile(t, "file.pcap", []byte("data"))
+
+			upload, err := client.SendFileContext(context.Background(), FileDetails{SourceFilename: path, PayloadType: "pcap"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := c.expected(path)
+			if upload.DisposedFilename != expected {
+				t.Fatalf("expected %q, got %q", expected, upload.DisposedFilename)
+			}
+			if _, err := os.Stat(path); (expected == path) != (err == nil) {
+				t.Fatalf("unexpected source file state: %v", err)
+			}
+			if expected != "" {
+				if data, err := os.ReadFile(expected); err != nil || string(data) != "data" {
+					t.Fatalf("expected disposed file %q, got %q, %v", expected, data, err)
+				}
+			}
+		})
+	}
+}
+
+func TestSendFileDispositionArchiveTime(t *testing.T) {
+	archive := t.TempDir()
+	_, client := testServer(t, Settings{Disposition: Disposition{Action: DispositionMove, Dir: archive}, Retention: Retention{MaxAgeDays: 30}})
+	// A capture written 40 days ago and uploaded now.
+	path := writeTestFile(t, "file.pcap", []byte("data"))
+	old := time.Now().AddDate(0, 0, -40)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	upload, err := client.SendFileContext(context.Background(), FileDetails{SourceFilename: path, PayloadType: "pcap"})
+	if err != nil || upload.DispositionError != nil {
+		t.Fatalf("unexpected errors %v, %v", err, upload.DispositionError)
+	}
+	removed, err := client.SweepArchive()
+	if err != nil || len(removed) != 0 {
+		t.Fatalf("expected the newly archived file to be kept, removed %v, %v", removed, err)
+	}
+	if _, err := os.Stat(upload.DisposedFilename); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSendFileDispositionNotApplied(t *testing.T) {
+	cases := []struct {
+		name     string
+		settings Settings
+		fault    bool
+	}{
+		{"failed upload", Settings{}, true},
+		{"dry run", Settings{DryRun: true}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.settings.Disposition = Disposition{Action: DispositionDelete}
+			server, client := testServer(t, c.settings)
+			if c.fault {
+				server.Inject(transmittertest.OpPutPart, 0, transmittertest.Fault{StatusCode: http.StatusInternalServerError})
+			}
+			path := writeTestFile(t, "file.pcap", []byte("data"))
+
+			_, err := client.SendFileContext(context.Background(), FileDetails{SourceFilename: path, PayloadType: "pcap"})
+			if (err != nil) != c.fault {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if _, err := os.Stat(path); err != nil {
+				t.Fatalf("expected source file to be kept, got %v", err)
+			}
+		})
+	}
+}
+
+func TestSendFileDispositionOverride(t *testing.T) {
+	_, client := testServer(t, Settings{Disposition: Disposition{Action: DispositionDelete}})
+	path := writeTestFile(t, "file.pcap", []byte("data"))
+
+	fd := FileDetails{SourceFilename: path, PayloadType: "pcap", Disposition: &Disposition{Action: DispositionKeep}}
+	if err := client.SendFile(fd); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected source file to be kept, got %v", err)
+	}
+
+	fd.Disposition = &Disposition{Action: "shred"}
+	if err := client.SendFile(fd); err == nil {
+		t.Fatal("expected error for unknown disposition")
+	}
+}
+
+func TestSendFileDispositionFailure(t *testing.T) {
+	dir := t.TempDir()
+	// A file where the archive directory should be.
+	archive := writeTestFile(t, "archive", nil)
+	hook := &recordingHook{}
+	server, client := testServer(t, Settings{Disposition: Disposition{Action: DispositionMove, Dir: archive}, Hooks: []Hook{hook}})
+	path := filepath.Join(dir, "file.pcap")
+	if err := os.WriteFile(path, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The upload succeeded, so it is not an error and must not be resent.
+	upload, err := client.SendFileContext(context.Background(), FileDetails{SourceFilename: path, DestinationFilename: "file.pcap", PayloadType: "pcap"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(upload.DispositionError, ErrDisposition) {
+		t.Fatalf("expected ErrDisposition, got %v", upload.DispositionError)
+	}
+	if hook.err != nil || !errors.Is(hook.result.DispositionError, ErrDisposition) {
+		t.Fatalf("expected hook to see a successful upload with a disposition error, got %v, %v", hook.err, hook.result.DispositionError)
+	}
+	if _, ok := server.Object("pcap/file.pcap"); !ok {
+		t.Fatal("expected upload to be stored")
+	}
+}
+
+func TestMoveFileKeepsExisting(t *testing.T) {
+	// copyFile is what moveFile falls back to across file systems.
+	for name, move := range map[string]func(string, string) (string, error){"link": moveFile, "copy": copyFile} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			target := filepath.Join(dir, "file.pcap")
+			if err := os.WriteFile(target, []byte("old"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			path := writeTestFile(t, "file.pcap", []byte("new"))
+
+			moved, err := move(path, target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if moved != target+".1" {
+				t.Fatalf("expected %s.1, got %s", target, moved)
+			}
+			if data, _ := os.ReadFile(target); string(data) != "old" {
+				t.Fatalf("existing file overwritten with %q", data)
+			}
+			if data, _ := os.ReadFile(moved); string(data) != "new" {
+				t.Fatalf("expected moved file to hold %q, got %q", "new", data)
+			}
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Fatalf("expected source file to be removed, got %v", err)
+			}
+		})
+	}
+}
+
+func TestRetentionSweep(t *testing.T) {
+	now := time.Now()
+	files := []struct {
+		name string
+		size int
+		age  time.Duration
+	}{
+		{"old.pcap", 1, 10 * 24 * time.Hour},
+		{"a.pcap", 4, 3 * time.Hour},
+		{"b.pcap", 4, 2 * time.Hour},
+		{"c.pcap", 4, time.Hour},
+		{"c.log", 100, 20 * 24 * time.Hour},
+	}
+	cases := []struct {
+		name      string
+		retention Retention
+		removed   int
+	}{
+		{"age", Retention{MaxAgeDays: 7}, 1},
+		{"quota", Retention{MaxBytes: 8}, 2},
+		{"both", Retention{MaxAgeDays: 7, MaxBytes: 4}, 3},
+		{"none", Retention{}, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, f := range files {
+				path := filepath.Join(dir, f.name)
+				if err := os.WriteFile(path, make([]byte, f.size), 0600); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chtimes(path, now.Add(-f.age), now.Add(-f.age)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			removed, err := c.retention.sweep(dir, ".pcap", now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(removed) != c.removed {
+				t.Fatalf("expected %d removed, got %v", c.removed, removed)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "c.log")); err != nil {
+				t.Fatal("file with other suffix removed")
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+/*
+ * NTT Security Holdings Go Library for Samurai
+ * Copyright 2023 NTT Security Holdings
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package transmitter
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+)
+
+// signedURLExpiryMargin is how long before its expiry a signed URL or SAS is
+// refreshed instead of used.
+const signedURLExpiryMargin = 30 * time.Second
+
+// maxSignatureRefreshes bounds how often the signed URL of one part or blob
+// is refreshed after being rejected as expired.
+const maxSignatureRefreshes = 3
+
+// queryValue returns the first value of the query parameter key, ignoring
+// the case of the parameter name.
+func queryValue(query url.Values, key string) string {
+	for name, values := range query {
+		if strings.EqualFold(name, key) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// signedURLExpiry returns the expiry time of an S3 presigned URL (signature
+// version 4 or 2) or an Azure SAS URL, when the URL carries one.
+func signedURLExpiry(rawURL string) (time.Time, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return time.Time{}, false
+	}
+	query := u.Query()
+	if date := queryValue(query, "x-amz-date"); date != "" {
+		signed, err := time.Parse("20060102T150405Z", date)
+		seconds, convErr := strconv.Atoi(queryValue(query, "x-amz-expires"))
+		if err != nil || convErr != nil {
+			return time.Time{}, false
+		}
+		return signed.Add(time.Duration(seconds) * time.Second), true
+	}
+	if se := query.Get("se"); se != "" {
+		for _, layout := range []string{time.RFC3339, "2006-01-02T15:04Z", "2006-01-02"} {
+			if expiry, err := time.Parse(layout, se); err == nil {
+				return expiry, true
+			}
+		}
+		return time.Time{}, false
+	}
+	if expires := query.Get("Expires"); expires != "" {
+		seconds, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return time.Unix(seconds, 0), true
+	}
+	return time.Time{}, false
+}
+
+// expiresSoon reports whether rawURL expires within signedURLExpiryMargin.
+// URLs without an expiry never do.
+func expiresSoon(rawURL string) bool {
+	expiry, ok := signedURLExpiry(rawURL)
+	return ok && time.Until(expiry) < signedURLExpiryMargin
+}
+
+// isExpiredS3Response reports whether a storage response rejects a
+// presigned URL because it has expired.
+func isExpiredS3Response(statusCode int, body []byte) bool {
+	if statusCode != http.StatusForbidden {
+		return false
+	}
+	return bytes.Contains(body, []byte("Request has expired")) ||
+		bytes.Contains(body, []byte("<Code>ExpiredToken</Code>")) ||
+		bytes.Contains(body, []byte("<Code>RequestExpired</Code>"))
+}
+
+// isExpiredAzureError reports whether Azure rejected a SAS. Azure answers an
+// expired SAS with AuthenticationFailed, the same code as for a bad
+// signature, so both lead to a refresh.
+func isExpiredAzureError(err error) bool {
+	var storageErr *azcore.ResponseError
+	return errors.As(err, &storageErr) && storageErr.StatusCode == http.StatusForbidden && storageErr.ErrorCode == "AuthenticationFailed"
+}
@@ -0,0 +1,120 @@
+package transmitter
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/SamuraiMDR/samurai-go/pkg/transmitter/transmittertest"
+)
+
+func TestSignedURLExpiry(t *testing.T) {
+	cases := []struct {
+		name   string
+		url    string
+		want   time.Time
+		wantOK bool
+	}{
+		{"s3 v4", "https://s3/k?X-Amz-Date=20240102T030405Z&X-Amz-Expires=900&X-Amz-Signature=s", time.Date(2024, 1, 2, 3, 19, 5, 0, time.UTC), true},
+		{"s3 v4 lowercase", "https://s3/k?x-amz-date=20240102T030405Z&x-amz-expires=60", time.Date(2024, 1, 2, 3, 5, 5, 0, time.UTC), true},
+		{"s3 v2", "https://s3/k?AWSAccessKeyId=a&Expires=1700000000&Signature=s", time.Unix(1700000000, 0), true},
+		{"azure", "https://blob/c/b?sv=2022-11-02&se=2024-01-02T03:04:05Z&sig=s", time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), true},
+		{"azure minutes", "https://blob/c/b?se=2024-01-02T03:04Z&sig=s", time.Date(2024, 1, 2, 3, 4, 0, 0, time.UTC), true},
+		{"azure date", "https://blob/c/b?se=2024-01-02&sig=s", time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), true},
+		{"no expiry", "https://s3/k?X-Amz-Signature=s", time.Time{}, false},
+		{"bad date", "https://s3/k?X-Amz-Date=yesterday&X-Amz-Expires=60", time.Time{}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, ok := signedURLExpiry(c.url)
+			if ok != c.wantOK || !got.Equal(c.want) {
+				t.Fatalf("signedURLExpiry() = %v, %v, want %v, %v", got, ok, c.want, c.wantOK)
+			}
+		})
+	}
+}
+
+func TestSendFileS3RefreshesExpiredURL(t *testing.T) {
+	withPartSize(t, 4)
+	server, client := testServer(t, Settings{MaxRetries: 1})
+	server.Inject(transmittertest.OpPutPart, 2, transmittertest.ExpiredS3Fault)
+	data := []byte("0123456789")
+
+	if err := client.SendFile(FileDetails{SourceFilename: writeTestFile(t, "file.pcap", data), DestinationFilename: "file.pcap", PayloadType: "pcap"}); err != nil {
+		t.Fatal(err)
+	}
+	object, ok := server.Object("pcap/file.pcap")
+	if !ok || !bytes.Equal(object.Data, data) {
+		t.Fatalf("expected complete object, got %q", object.Data)
+	}
+	if n := server.Requests(transmittertest.OpGetSignedURL); n != 5 {
+		t.Fatalf("expected 3 signed URLs and 2 refreshes, got %d requests", n)
+	}
+}
+
+func TestSendFileS3RefreshesExpiringURL(t *testing.T) {
+	withPartSize(t, 4)
+	// URLs are issued by a server clock an hour behind, so they expire within
+	// the refresh margin by the client clock while the server accepts them.
+	opts := transmittertest.Options{
+		SignedURLTTL: time.Hour + 10*time.Second,
+		Now:          func() time.Time { return time.Now().Add(-time.Hour) },
+	}
+	server, client := testServerWithOptions(t, opts, Settings{})
+
+	if err := client.SendFile(FileDetails{SourceFilename: writeTestFile(t, "file.pcap", []byte("0123456789")), PayloadType: "pcap"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := server.Requests(transmittertest.OpGetSignedURL); n != 6 {
+		t.Fatalf("expected every part URL to be refreshed once, got %d requests", n)
+	}
+}
+
+func TestSendFileS3GivesUpOnExpiredURLs(t *testing.T) {
+	server, client := testServerWithOptions(t, transmittertest.Options{SignedURLTTL: time.Nanosecond}, Settings{})
+
+	if err := client.SendFile(FileDetails{SourceFilename: writeTestFile(t, "file.pcap", []byte("data")), PayloadType: "pcap"}); err == nil {
+		t.Fatal("expected error")
+	}
+	if n := server.Requests(transmittertest.OpGetSignedURL); n != 1+maxSignatureRefreshes {
+		t.Fatalf("expected %d signed URL requests, got %d", 1+maxSignatureRefreshes, n)
+	}
+	if len(server.Aborted()) != 1 {
+		t.Fatalf("expected the upload to be aborted, got %v", server.Aborted())
+	}
+}
+
+func TestSendFileAzureRefreshesRejectedSAS(t *testing.T) {
+	server, client := testServer(t, Settings{Profile: "azure", MaxRetries: 1})
+	server.Inject(transmittertest.OpPutBlob, 1, transmittertest.ExpiredAzureFault)
+	data := []byte("azure data")
+
+	upload, err := client.SendFileContext(context.Background(), FileDetails{SourceFilename: writeTestFile(t, "file.json", data), DestinationFilename: "file.json", PayloadType: "bouncer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	object, ok := server.Object("bouncer/file.json")
+	if !ok || !bytes.Equal(object.Data, data) || upload.BlobID != "bouncer/file.json" {
+		t.Fatalf("expected stored blob, got %q, result %+v", object.Data, upload)
+	}
+	if n := server.Requests(transmittertest.OpToken); n != 2 {
+		t.Fatalf("expected one SAS refresh, got %d token requests", n)
+	}
+}
+
+func TestSendFileAzureRefreshesExpiringSAS(t *testing.T) {
+	opts := transmittertest.Options{
+		SignedURLTTL: time.Hour + 10*time.Second,
+		Now:          func() time.Time { return time.Now().Add(-time.Hour) },
+	}
+	server, client := testServerWithOptions(t, opts, Settings{Profile: "azure"})
+
+	upload, err := client.SendFileContext(context.Background(), FileDetails{SourceFilename: writeTestFile(t, "file.json", []byte("{}")), PayloadType: "bouncer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := server.Object(upload.BlobID); !ok || server.Requests(transmittertest.OpToken) != 2 {
+		t.Fatalf("expected upload with a refreshed SAS, got %+v after %d token requests", upload, server.Requests(transmittertest.OpToken))
+	}
+}
@@ -0,0 +1,194 @@
+/*
+ * NTT Security Holdings Go Library for Samurai
+ * Copyright 2023 NTT Security Holdings
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package transmitter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultHookTimeout bounds an ExecHook command without a Timeout.
+const defaultHookTimeout = 30 * time.Second
+
+// ErrSkipped is returned by a Hook's BeforeUpload to skip an upload by
+// policy.
+var ErrSkipped = errors.New("upload skipped")
+
+// Hook runs custom logic around uploads. Hooks are called in the order of
+// Settings.Hooks for every upload.
+type Hook interface {
+	// BeforeUpload may change fd, for example to point SourceFilename at a
+	// redacted copy or to add Metadata. An error stops the upload.
+	BeforeUpload(ctx context.Context, fd *FileDetails) error
+	// AfterUpload is called with the result and error of every upload,
+	// including those stopped by BeforeUpload.
+	AfterUpload(ctx context.Context, upload UploadResult, err error)
+}
+
+// beforeUpload calls BeforeUpload on each hook until one fails.
+func (client Client) beforeUpload(ctx context.Context, fd *FileDetails) error {
+	for _, hook := range client.settings.Hooks {
+		if err := hook.BeforeUpload(ctx, fd); err != nil {
+			log.Infof("Upload of %v stopped by hook: %v", fd.SourceFilename, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// afterUpload calls AfterUpload on each hook. They run even when ctx has
+// ended, so a cancelled upload is still reported.
+func (client Client) afterUpload(ctx context.Context, upload UploadResult, err error) {
+	ctx = context.WithoutCancel(ctx)
+	for _, hook := range client.settings.Hooks {
+		hook.AfterUpload(ctx, upload, err)
+	}
+}
+
+// ExecHook runs commands before and after uploads with the upload details
+// in SAMURAI_* environment variables. A Before command that exits non-zero
+// skips the upload, while one that cannot be started or times out fails it;
+// After command failures are only logged.
+type ExecHook struct {
+	// Before and After are a command and its arguments, run without a shell.
+	Before []string `yaml:"before"`
+	After  []string `yaml:"after"`
+	// Timeout bounds each command, default 30 seconds.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (h ExecHook) configured() bool {
+	return len(h.Before) > 0 || len(h.After) > 0
+}
+
+func (h ExecHook) BeforeUpload(ctx context.Context, fd *FileDetails) error {
+	if len(h.Before) == 0 {
+		return nil
+	}
+	env := append(fileDetailsEnv(*fd), "SAMURAI_HOOK=before")
+	err := h.run(ctx, h.Before, env)
+	if err == nil {
+		return nil
+	}
+	// Only a command that ran and said no skips the upload. A hook that
+	// cannot run or times out is a failure, not a policy decision.
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+		return fmt.Errorf("%w: %v", ErrSkipped, err)
+	}
+	return fmt.Errorf("before upload hook failed: %w", err)
+}
+
+func (h ExecHook) AfterUpload(ctx context.Context, upload UploadResult, err error) {
+	if len(h.After) == 0 {
+		return
+	}
+	env := append(uploadResultEnv(upload, err), "SAMURAI_HOOK=after")
+	if err := h.run(ctx, h.After, env); err != nil {
+		log.Errorf("After upload hook for %v failed: %v", upload.SourceFilename, err)
+	}
+}
+
+// run runs command with env added to the environment and returns an error
+// including its output when it fails.
+func (h ExecHook) run(ctx context.Context, command []string, env []string) error {
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Env = append(os.Environ(), env...)
+	// Do not wait for children that keep the output open after a timeout.
+	cmd.WaitDelay = time.Second
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		if text := strings.TrimSpace(output.String()); text != "" {
+			return fmt.Errorf("%s: %w: %s", command[0], err, text)
+		}
+		return fmt.Errorf("%s: %w", command[0], err)
+	}
+	log.Debugf("Hook %s: %s", command[0], strings.TrimSpace(output.String()))
+	return nil
+}
+
+// fileDetailsEnv describes fd in environment variables. Metadata keys are
+// lowercase letters, so SAMURAI_METADATA_<KEY> is always a valid name.
+func fileDetailsEnv(fd FileDetails) []string {
+	env := []string{
+		"SAMURAI_SOURCE_FILENAME=" + fd.SourceFilename,
+		"SAMURAI_DESTINATION_FILENAME=" + fd.DestinationFilename,
+		"SAMURAI_FILE_SUFFIX=" + fd.FileSuffix,
+		"SAMURAI_PAYLOAD_TYPE=" + fd.PayloadType,
+	}
+	if fd.CustomKey != "" {
+		env = append(env, "SAMURAI_CUSTOM_KEY="+fd.CustomKey, "SAMURAI_CUSTOM_VALUE="+fd.CustomValue)
+	}
+	keys := make([]string, 0, len(fd.Metadata))
+	for key := range fd.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		env = append(env, "SAMURAI_METADATA_"+strings.ToUpper(key)+"="+fd.Metadata[key])
+	}
+	return env
+}
+
+// uploadResultEnv describes an upload and its outcome in environment
+// variables.
+func uploadResultEnv(upload UploadResult, err error) []string {
+	status := "success"
+	message := ""
+	if err != nil {
+		status = "failure"
+		message = err.Error()
+	}
+	disposition := ""
+	if upload.DispositionError != nil {
+		disposition = upload.DispositionError.Error()
+	}
+	return []string{
+		"SAMURAI_STATUS=" + status,
+		"SAMURAI_ERROR=" + message,
+		"SAMURAI_SOURCE_FILENAME=" + upload.SourceFilename,
+		"SAMURAI_DESTINATION_FILENAME=" + upload.DestinationFilename,
+		"SAMURAI_DISPOSED_FILENAME=" + upload.DisposedFilename,
+		"SAMURAI_DISPOSITION_ERROR=" + disposition,
+		"SAMURAI_PAYLOAD_TYPE=" + upload.PayloadType,
+		"SAMURAI_FILE_SUFFIX=" + upload.Suffix,
+		"SAMURAI_BACKEND=" + upload.Backend,
+		"SAMURAI_KEY=" + upload.Key,
+		"SAMURAI_BLOB_ID=" + upload.BlobID,
+		"SAMURAI_SIZE=" + strconv.FormatInt(upload.Size, 10),
+		"SAMURAI_SHA256=" + upload.SHA256,
+		"SAMURAI_DRY_RUN=" + strconv.FormatBool(upload.DryRun),
+	}
+}
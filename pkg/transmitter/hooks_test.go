@@ -0,0 +1,173 @@
+package transmitter
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingHook records the calls it gets and runs before on BeforeUpload.
+type recordingHook struct {
+	before func(fd *FileDetails) error
+	calls  []string
+	result UploadResult
+	err    error
+}
+
+func (h *recordingHook) BeforeUpload(ctx context.Context, fd *FileDetails) error {
+	h.calls = append(h.calls, "before")
+	if h.before != nil {
+		return h.before(fd)
+	}
+	return nil
+}
+
+func (h *recordingHook) AfterUpload(ctx context.Context, upload UploadResult, err error) {
+	h.calls = append(h.calls, "after")
+	h.result = upload
+	h.err = err
+}
+
+func TestSendFileHooks(t *testing.T) {
+	first := &recordingHook{before: func(fd *FileDetails) error {
+		fd.Metadata = map[string]string{"site": "oslo"}
+		return nil
+	}}
+	second := &recordingHook{}
+	server, client := testServer(t, Settings{Hooks: []Hook{first, second}})
+	path := writeTestFile(t, "file.pcap", []byte("data"))
+
+	if err := client.SendFile(FileDetails{SourceFilename: path, DestinationFilename: "file.pcap", PayloadType: "pcap"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, hook := range []*recordingHook{first, second} {
+		if strings.Join(hook.calls, ",") != "before,after" || hook.err != nil || hook.result.Key == "" {
+			t.Fatalf("unexpected hook calls %v, result %+v, error %v", hook.calls, hook.result, hook.err)
+		}
+	}
+	object, ok := server.Object("pcap/file.pcap")
+	if !ok || object.Metadata["site"] != "oslo" {
+		t.Fatalf("expected metadata added by hook, got %v", object.Metadata)
+	}
+}
+
+func TestSendFileHookSkips(t *testing.T) {
+	skip := &recordingHook{before: func(fd *FileDetails) error { return ErrSkipped }}
+	later := &recordingHook{}
+	server, client := testServer(t, Settings{Hooks: []Hook{skip, later}})
+	path := writeTestFile(t, "file.pcap", []byte("data"))
+
+	err := client.SendFile(FileDetails{SourceFilename: path, PayloadType: "pcap"})
+	if !errors.Is(err, ErrSkipped) {
+		t.Fatalf("expected ErrSkipped, got %v", err)
+	}
+	if strings.Join(later.calls, ",") != "after" || !errors.Is(later.err, ErrSkipped) {
+		t.Fatalf("expected only AfterUpload with the error, got %v, %v", later.calls, later.err)
+	}
+	if len(server.Objects()) != 0 {
+		t.Fatalf("expected no objects, got %d", len(server.Objects()))
+	}
+}
+
+func TestSendFileHookReplacesSource(t *testing.T) {
+	redacted := writeTestFile(t, "redacted.pcap", []byte("xxxx"))
+	hook := &recordingHook{before: func(fd *FileDetails) error {
+		fd.SourceFilename = redacted
+		return nil
+	}}
+	server, client := testServer(t, Settings{Hooks: []Hook{hook}, Disposition: Disposition{Action: DispositionDelete}})
+	path := writeTestFile(t, "file.pcap", []byte("data"))
+
+	if err := client.SendFile(FileDetails{SourceFilename: path, DestinationFilename: "file.pcap", PayloadType: "pcap"}); err != nil {
+		t.Fatal(err)
+	}
+	if object, _ := server.Object("pcap/file.pcap"); string(object.Data) != "xxxx" {
+		t.Fatalf("expected redacted content, got %q", object.Data)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected original file to be deleted, got %v", err)
+	}
+	if _, err := os.Stat(redacted); err != nil {
+		t.Fatalf("expected redacted file to be kept, got %v", err)
+	}
+}
+
+func TestExecHook(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no /bin/sh")
+	}
+	out := filepath.Join(t.TempDir(), "out")
+	cases := []struct {
+		name   string
+		before string
+		err    error
+		output string
+	}{
+		{"success", "true", nil, "after success pcap file.pcap " + sha256Hex([]byte("data"))},
+		{"skip", "echo not today; exit 1", ErrSkipped, "after failure pcap  "},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			hook := ExecHook{
+				Before: []string{"/bin/sh", "-c", c.before},
+				After:  []string{"/bin/sh", "-c", `echo "$SAMURAI_HOOK $SAMURAI_STATUS $SAMURAI_PAYLOAD_TYPE $SAMURAI_DESTINATION_FILENAME $SAMURAI_SHA256" > ` + out},
+			}
+			_, client := testServer(t, Settings{ExecHook: hook})
+			path := writeTestFile(t, "file.pcap", []byte("data"))
+
+			err := client.SendFile(FileDetails{SourceFilename: path, DestinationFilename: "file.pcap", PayloadType: "pcap"})
+			if !errors.Is(err, c.err) {
+				t.Fatalf("expected %v, got %v", c.err, err)
+			}
+			if c.err != nil && !strings.Contains(err.Error(), "not today") {
+				t.Fatalf("expected command output in error, got %v", err)
+			}
+			data, err := os.ReadFile(out)
+			if err != nil || strings.TrimSpace(string(data)) != strings.TrimSpace(c.output) {
+				t.Fatalf("expected %q, got %q, %v", c.output, data, err)
+			}
+		})
+	}
+}
+
+func TestExecHookFailure(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no /bin/sh")
+	}
+	cases := []struct {
+		name string
+		hook ExecHook
+	}{
+		{"missing command", ExecHook{Before: []string{filepath.Join(t.TempDir(), "missing")}}},
+		{"not executable", ExecHook{Before: []string{writeTestFile(t, "hook.sh", []byte("exit 0"))}}},
+		{"timeout", ExecHook{Before: []string{"/bin/sh", "-c", "sleep 5"}, Timeout: 50 * time.Millisecond}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			server, client := testServer(t, Settings{ExecHook: c.hook})
+			path := writeTestFile(t, "file.pcap", []byte("data"))
+
+			err := client.SendFile(FileDetails{SourceFilename: path, DestinationFilename: "file.pcap", PayloadType: "pcap"})
+			if err == nil || errors.Is(err, ErrSkipped) {
+				t.Fatalf("expected a hook failure rather than a skip, got %v", err)
+			}
+			if len(server.Objects()) != 0 {
+				t.Fatalf("expected no upload, got %v", server.Objects())
+			}
+		})
+	}
+}
+
+func TestFileDetailsEnv(t *testing.T) {
+	env := fileDetailsEnv(FileDetails{SourceFilename: "a.pcap", PayloadType: "pcap", CustomKey: "source", CustomValue: "x", Metadata: map[string]string{"site": "oslo"}})
+	joined := strings.Join(env, "\n")
+	for _, expected := range []string{"SAMURAI_SOURCE_FILENAME=a.pcap", "SAMURAI_CUSTOM_KEY=source", "SAMURAI_CUSTOM_VALUE=x", "SAMURAI_METADATA_SITE=oslo"} {
+		if !strings.Contains(joined, expected) {
+			t.Fatalf("expected %s in %v", expected, env)
+		}
+	}
+}
@@ -17,9 +17,10 @@
 package transmitter
 
 import (
-	"bytes"
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
-	"encoding/json"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -27,9 +28,10 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"sort"
 	"strings"
-	"sync"
+	"text/template"
 	"time"
 
 	"github.com/SamuraiMDR/samurai-go/pkg/credentials"
@@ -42,25 +44,101 @@ type Settings struct {
 	Debug            bool   `yaml:"debug"`
 	Profile          string `yaml:"profile"`
 	MaxRetries       int    `yaml:"max_retries"`
+	// RetryBackoff is the wait before the first retry of a storage upload,
+	// growing linearly with each further try. Defaults to one second.
+	RetryBackoff time.Duration `yaml:"retry_backoff"`
+	// SignedURLPrefetch is how many S3 part URLs are requested concurrently
+	// ahead of the part uploads, defaults to 3. An upload holds at most
+	// 3+SignedURLPrefetch parts of 100MB in memory.
+	SignedURLPrefetch int `yaml:"signed_url_prefetch"`
+	// StateDir, when set, is where pending S3 multipart uploads are recorded
+	// so that CleanupStale can abort them after a crash.
+	StateDir string `yaml:"state_dir"`
+	// DestinationTemplate names uploads without a DestinationFilename, see
+	// DestinationData for the available fields.
+	DestinationTemplate string `yaml:"destination_template"`
+	// Disposition applies to source files after a successful upload, and
+	// Retention to the files it archives, see SweepArchive.
+	Disposition Disposition `yaml:"disposition"`
+	Retention   Retention   `yaml:"retention"`
+	// Hooks run around every upload. ExecHook, when configured, runs after
+	// them.
+	Hooks    []Hook   `yaml:"-"`
+	ExecHook ExecHook `yaml:"exec_hook"`
+	// Transformers rewrite content in order as it is uploaded, after it
+	// has been validated and checked against the catalog.
+	Transformers []Transformer `yaml:"-"`
+	// SpoolDir holds transformed files while they are uploaded to Azure,
+	// which retries a blob from the start. It defaults to StateDir, then to
+	// the system temporary directory.
+	SpoolDir string `yaml:"spool_dir"`
+	// AuditLog is a JSONL file with a hash chained entry per upload
+	// attempt, rotated at AuditLogMaxSize bytes (default 100MB).
+	AuditLog        string `yaml:"audit_log"`
+	AuditLogMaxSize int64  `yaml:"audit_log_max_size"`
+	// DryRun validates uploads and reports the plan without transferring
+	// data. With DryRunRequestToken the token request is sent as well, to
+	// check credentials and payload type against the service.
+	DryRun             bool `yaml:"dry_run"`
+	DryRunRequestToken bool `yaml:"dry_run_request_token"`
+	// Catalog, when set, is checked before a token is requested. Without
+	// one the service alone decides, see DefaultCatalog.
+	Catalog *Catalog `yaml:"-"`
+	// ValidateContent enables DefaultValidators when Validators is not set.
+	ValidateContent bool `yaml:"validate_content"`
+	// Validators check file content by payload type before a token is
+	// requested.
+	Validators map[string]Validator `yaml:"-"`
+	// Transport, when set, carries all requests to the payload API and
+	// storage instead of a clone of http.DefaultTransport. AllowInsecureTLS
+	// is not applied to it.
+	Transport http.RoundTripper `yaml:"-"`
 }
 
-type control struct {
-	EndpointWG       *sync.WaitGroup
-	StopChan         chan struct{}
-	PartsChan        chan interface{}
-	HaltTransmitters bool
+// newTransport returns the transport for a client built from settings.
+func newTransport(settings Settings) http.RoundTripper {
+	if settings.Transport != nil {
+		return settings.Transport
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Keep a connection per concurrent request alive between parts.
+	transport.MaxIdleConnsPerHost = max(partsTransmitterWorkers, settings.SignedURLPrefetch)
+	if settings.AllowInsecureTLS {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return transport
 }
 
 var ErrUnknownPayload = errors.New("unknown payload")
 var ErrFileExists = errors.New("file already exists")
 
+// maxMetadataPairs caps the number of custom key/value pairs, including
+// CustomKey/CustomValue, that can be attached to a single upload.
+const maxMetadataPairs = 10
+
+// reservedMetadataKeys are keys the payload API uses itself and will not
+// accept as custom metadata.
+var reservedMetadataKeys = map[string]bool{
+	"payload":     true,
+	"profile":     true,
+	"suffix":      true,
+	"filename":    true,
+	"key":         true,
+	"blob":        true,
+	"device":      true,
+	"deviceid":    true,
+	"integration": true,
+	"event":       true,
+	"type":        true,
+}
+
 // customKVRe enforces the same rules the payload API applies to a custom
 // key/value pair: lowercase letters only, length 1-20.
 var customKVRe = regexp.MustCompile(`^[a-z]{1,20}$`)
 
 // validateCustomKV mirrors the server-side validation so callers fail fast
 // instead of after a round trip. Both must be set together and match the
-// allowed pattern. Reserved-key collisions remain a server-side check.
+// allowed pattern. Reserved keys are checked by validateMetadata.
 func validateCustomKV(key, value string) error {
 	if key == "" && value == "" {
 		return nil
@@ -74,13 +152,48 @@ func validateCustomKV(key, value string) error {
 	return nil
 }
 
+// validateMetadata applies validateCustomKV to every pair and additionally
+// rejects reserved keys, duplicates of customKey and more than
+// maxMetadataPairs pairs in total.
+func validateMetadata(metadata map[string]string, customKey string) error {
+	total := len(metadata)
+	if customKey != "" {
+		total++
+	}
+	if total > maxMetadataPairs {
+		return fmt.Errorf("too many metadata pairs: %d, max %d", total, maxMetadataPairs)
+	}
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := metadata[key]
+		if err := validateCustomKV(key, value); err != nil {
+			return fmt.Errorf("metadata %q: %v", key, err)
+		}
+		if reservedMetadataKeys[key] {
+			return fmt.Errorf("metadata key %q is reserved", key)
+		}
+		if key == customKey {
+			return fmt.Errorf("metadata key %q duplicates customKey", key)
+		}
+	}
+	if reservedMetadataKeys[customKey] {
+		return fmt.Errorf("customKey %q is reserved", customKey)
+	}
+	return nil
+}
+
 type sas struct {
-	Payload     string `json:"payload"`
-	Profile     string `json:"profile"`
-	Suffix      string `json:"suffix"`
-	Filename    string `json:"filename"`
-	CustomKey   string `json:"customKey,omitempty"`
-	CustomValue string `json:"customValue,omitempty"`
+	Payload     string            `json:"payload"`
+	Profile     string            `json:"profile"`
+	Suffix      string            `json:"suffix"`
+	Filename    string            `json:"filename"`
+	CustomKey   string            `json:"customKey,omitempty"`
+	CustomValue string            `json:"customValue,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
 }
 
 type sasResult struct {
@@ -91,95 +204,260 @@ type sasResult struct {
 	BlobID   string `json:"blob_id"`
 }
 
+// Client uploads files to Samurai. A Client is not modified after NewClient
+// returns and is safe for concurrent use by multiple goroutines.
 type Client struct {
-	credentials credentials.APICredentials
-	settings    Settings
+	provider   credentials.Provider
+	settings   Settings
+	httpClient *http.Client
+	journal    *uploadJournal
+	lifecycle  *lifecycle
+	auditLog   *auditLog
+
+	destinationTemplate *template.Template
 }
 
 type FileDetails struct {
-	SourceFilename      string
+	SourceFilename string
+	// DestinationFilename names the upload. It may be a template, see
+	// DestinationData.
 	DestinationFilename string
 	FileSuffix          string
 	PayloadType         string
 	CustomKey           string
 	CustomValue         string
+	// Metadata holds additional custom key/value pairs sent with the token
+	// request. Keys and values follow the same rules as CustomKey/CustomValue.
+	Metadata map[string]string
+	// Disposition overrides Settings.Disposition for this file.
+	Disposition *Disposition
 }
 
-func getSAS(payload string, destinationFilename string, suffix string, customKey string, customValue string, credentials credentials.APICredentials, settings Settings) (sasResult, error) {
-	var result sasResult
+// UploadResult describes a finished upload, or the planned upload in a dry
+// run. Backend, Key and BlobID are only known once a token was requested.
+type UploadResult struct {
+	SourceFilename      string
+	DestinationFilename string
+	PayloadType         string
+	Suffix              string
+	// Backend is the storage type returned by the service, "azure" or "s3".
+	Backend  string
+	Key      string
+	BlobID   string
+	Size     int64
+	SHA256   string
+	PartSize int64
+	Parts    int
+	DryRun   bool
+	// DisposedFilename is where a source file is after its disposition,
+	// empty when it was deleted.
+	DisposedFilename string
+	// DispositionError, wrapping ErrDisposition, is set when the upload
+	// succeeded but the source file could not be disposed of. The file
+	// must not be sent again.
+	DispositionError error
+}
 
-	body, err := json.Marshal(sas{payload, settings.Profile, suffix, destinationFilename, customKey, customValue})
+// fileChecksum returns the size and hex encoded SHA-256 of a file.
+func fileChecksum(filename string) (int64, string, error) {
+	file, err := os.Open(filename)
 	if err != nil {
-		return result, err
+		return 0, "", err
 	}
-	HTTPClient := &http.Client{
-		Timeout: time.Second * 10,
+	defer file.Close()
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, file)
+	if err != nil {
+		return 0, "", err
 	}
+	return size, hex.EncodeToString(hasher.Sum(nil)), nil
+}
 
-	defer HTTPClient.CloseIdleConnections()
-	request, err := http.NewRequest("POST", credentials.URL+"/cts/payload", bytes.NewBuffer(body))
-	if err != nil {
-		return result, err
-	}
-	request.Header.Add("Content-Type", "application/json")
-	request.Header.Add("x-api-key", credentials.APIKey)
-	request.Header.Add("passkey", credentials.Passkey)
-	if credentials.IntegrationId != "" {
-		request.Header.Add("integration_id", credentials.IntegrationId)
-		request.Header.Add("integrationid", credentials.IntegrationId)
-	} else {
-		request.Header.Add("device_id", credentials.DeviceId)
-		request.Header.Add("deviceid", credentials.DeviceId)
+// NewClient creates a transmitter client. Credentials are retrieved from the
+// provider and validated at the start of every SendFile; a static
+// credentials.APICredentials value can be passed directly and is validated
+// immediately.
+func NewClient(settings Settings, provider credentials.Provider) (Client, error) {
+	if provider == nil {
+		return Client{}, fmt.Errorf("credentials provider is required")
 	}
-	for key, value := range credentials.ExtraHeaders {
-		request.Header.Add(key, value)
+	if static, ok := provider.(credentials.APICredentials); ok {
+		if err := static.Validate(); err != nil {
+			return Client{}, err
+		}
 	}
-
-	response, err := HTTPClient.Do(request)
-	if err != nil {
-		return result, err
+	client := Client{
+		settings: settings,
+		provider: provider,
+	}
+	if client.settings.MaxRetries == 0 {
+		client.settings.MaxRetries = 3
+	}
+	if client.settings.Profile == "" {
+		client.settings.Profile = "default"
+	}
+	if client.settings.RetryBackoff == 0 {
+		client.settings.RetryBackoff = time.Second
+	}
+	if client.settings.SignedURLPrefetch <= 0 {
+		client.settings.SignedURLPrefetch = 3
 	}
-	defer response.Body.Close()
-	bodyBytes, err := io.ReadAll(response.Body)
+	if client.settings.Validators == nil && client.settings.ValidateContent {
+		client.settings.Validators = DefaultValidators()
+	}
+	journal, err := newUploadJournal(client.settings.StateDir)
 	if err != nil {
-		return result, err
+		return Client{}, err
 	}
-	switch response.StatusCode {
-	case 200:
-		err := json.Unmarshal(bodyBytes, &result)
-		if err != nil {
-			return result, err
+	client.journal = journal
+	if client.auditLog, err = newAuditLog(client.settings.AuditLog, client.settings.AuditLogMaxSize); err != nil {
+		return Client{}, err
+	}
+	client.lifecycle = newLifecycle()
+	if err := client.settings.Disposition.validate(); err != nil {
+		return Client{}, err
+	}
+	if client.settings.ExecHook.configured() {
+		client.settings.Hooks = append(slices.Clip(client.settings.Hooks), client.settings.ExecHook)
+	}
+	if client.settings.DestinationTemplate != "" {
+		if client.destinationTemplate, err = parseDestinationTemplate(client.settings.DestinationTemplate); err != nil {
+			return Client{}, err
 		}
-	case 415:
-		return result, ErrUnknownPayload
-	default:
-		err := fmt.Errorf("status code: %d, Body: %v", response.StatusCode, string(bodyBytes))
-		return result, err
 	}
-	return result, nil
+	// Storage uploads get their own transport so AllowInsecureTLS does not
+	// leak into http.DefaultTransport and other clients.
+	client.httpClient = &http.Client{Transport: newTransport(client.settings), Timeout: storageTimeout}
+	return client, nil
 }
 
-func NewClient(settings Settings, credentials credentials.APICredentials) (Client, error) {
-	client := Client{
-		settings:    settings,
-		credentials: credentials,
+// validateContent runs the validator registered for payload, if any.
+// Streams cannot be read twice and are not validated.
+func (client Client) validateContent(c *content, payload string, suffix string) error {
+	validator, ok := client.settings.Validators[payload]
+	if !ok {
+		return nil
 	}
-	if client.settings.MaxRetries == 0 {
-		client.settings.MaxRetries = 3
+	r, closer, err := c.readerAt()
+	if err != nil {
+		return err
 	}
-	return client, nil
+	defer closer()
+	if r == nil {
+		log.Debugf("Streamed %v payload is not validated", payload)
+		return nil
+	}
+	if err := validator.Validate(r, c.size, suffix); err != nil {
+		return &ContentError{PayloadType: payload, Err: err}
+	}
+	return nil
 }
 
+// SendFile uploads the file described by fd. It is SendFileContext without a
+// context and result.
 func (client Client) SendFile(fd FileDetails) error {
-	var suffix string
+	_, err := client.SendFileContext(context.Background(), fd)
+	return err
+}
 
-	if client.settings.Profile == "" {
-		client.settings.Profile = "default"
+// SendFileContext uploads the file described by fd and reports what was
+// uploaded. With Settings.DryRun it validates the upload and returns the plan
+// without transferring any data. After Shutdown it fails with ErrShutdown.
+func (client Client) SendFileContext(ctx context.Context, fd FileDetails) (UploadResult, error) {
+	return client.send(ctx, fd, fileContent(fd.SourceFilename))
+}
+
+// SendBytes uploads data as described by fd. It is SendBytesContext without a
+// context and result.
+func (client Client) SendBytes(data []byte, fd FileDetails) error {
+	_, err := client.SendBytesContext(context.Background(), data, fd)
+	return err
+}
+
+// SendBytesContext uploads data like SendFileContext uploads a file. The
+// suffix is taken from fd.FileSuffix, or from fd.SourceFilename, which is
+// otherwise only used in logs and results.
+func (client Client) SendBytesContext(ctx context.Context, data []byte, fd FileDetails) (UploadResult, error) {
+	return client.send(ctx, fd, bytesContent(data))
+}
+
+// SendReader uploads what is read from r as described by fd. It is
+// SendReaderContext without a context and result.
+func (client Client) SendReader(r io.Reader, size int64, fd FileDetails) error {
+	_, err := client.SendReaderContext(context.Background(), r, size, fd)
+	return err
+}
+
+// SendReaderContext uploads exactly size bytes read from r, or all of r when
+// size is negative, without buffering more than a few parts in memory. The
+// size and checksum in the result are computed while r is read, and content
+// validators are not run. Since r can only be read once, a failed Azure
+// upload is not retried; S3 parts are retried as usual. A dry run reads all
+// of r.
+func (client Client) SendReaderContext(ctx context.Context, r io.Reader, size int64, fd FileDetails) (UploadResult, error) {
+	return client.send(ctx, fd, streamContent(r, size))
+}
+
+// spoolDir is where transformed files are spooled for Azure uploads.
+func (client Client) spoolDir() string {
+	if client.settings.SpoolDir != "" {
+		return client.settings.SpoolDir
 	}
+	return client.settings.StateDir
+}
 
-	if client.settings.AllowInsecureTLS {
-		http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: client.settings.AllowInsecureTLS}
+// send runs an upload as part of the client lifecycle. Files interrupted by
+// Shutdown are queued.
+func (client Client) send(ctx context.Context, fd FileDetails, c *content) (UploadResult, error) {
+	started := time.Now()
+	ctx, done, err := client.lifecycle.begin(ctx)
+	if err != nil {
+		client.audit(started, fd, UploadResult{}, err)
+		return UploadResult{}, err
+	}
+	defer done()
+
+	upload, sent, err := client.sendHooked(ctx, fd, c)
+	client.audit(started, sent, upload, err)
+	if err != nil && client.lifecycle.interrupted() {
+		if c.path != "" {
+			client.queue(fd)
+		} else {
+			log.Warnf("Upload of %v was cancelled by shutdown, in-memory content is not queued", fd.SourceFilename)
+		}
+	}
+	client.afterUpload(ctx, upload, err)
+	return upload, err
+}
+
+// sendHooked lets hooks change fd before sending it and returns the
+// details that were sent. A file is still disposed of under its original
+// name, so a hook may send a copy of it.
+func (client Client) sendHooked(ctx context.Context, fd FileDetails, c *content) (UploadResult, FileDetails, error) {
+	hooked := fd
+	if err := client.beforeUpload(ctx, &hooked); err != nil {
+		return UploadResult{SourceFilename: fd.SourceFilename, PayloadType: fd.PayloadType}, hooked, err
+	}
+	if hooked.Disposition != nil {
+		if err := hooked.Disposition.validate(); err != nil {
+			return UploadResult{}, hooked, err
+		}
+	}
+	if c.path != "" && hooked.SourceFilename != fd.SourceFilename {
+		c = fileContent(hooked.SourceFilename)
+	}
+	upload, err := client.sendContent(ctx, hooked, c)
+	if err == nil && c.path != "" {
+		disposed := hooked
+		disposed.SourceFilename = fd.SourceFilename
+		upload.DisposedFilename = fd.SourceFilename
+		client.dispose(disposed, &upload)
 	}
+	return upload, hooked, err
+}
+
+func (client Client) sendContent(ctx context.Context, fd FileDetails, c *content) (UploadResult, error) {
+	var suffix string
 
 	if fd.FileSuffix == "" {
 		suffix = strings.Trim(filepath.Ext(fd.SourceFilename), ".")
@@ -187,140 +465,179 @@ func (client Client) SendFile(fd FileDetails) error {
 		suffix = fd.FileSuffix
 	}
 	if suffix == "" {
-		return fmt.Errorf("filename %v does not have a file suffix, please set fileSuffix", fd.SourceFilename)
+		return UploadResult{}, fmt.Errorf("filename %v does not have a file suffix, please set fileSuffix", fd.SourceFilename)
+	}
+	if fd.PayloadType == "" {
+		return UploadResult{}, fmt.Errorf("payload type is required")
 	}
 
 	if err := validateCustomKV(fd.CustomKey, fd.CustomValue); err != nil {
-		return fmt.Errorf("invalid custom key/value: %v", err)
+		return UploadResult{}, fmt.Errorf("invalid custom key/value: %v", err)
+	}
+	if err := validateMetadata(fd.Metadata, fd.CustomKey); err != nil {
+		return UploadResult{}, fmt.Errorf("invalid metadata: %v", err)
+	}
+
+	if err := c.measure(); err != nil {
+		return UploadResult{}, err
+	}
+	size := c.size
+	if err := client.settings.Catalog.Check(fd.PayloadType, suffix, max(size, 0)); err != nil {
+		log.Warnf("Uploading file %v aborted: %v", fd.SourceFilename, err)
+		return UploadResult{}, err
+	}
+	if c.stream != nil {
+		if t, ok := client.settings.Catalog.Lookup(fd.PayloadType); ok {
+			c.stream.limit = t.MaxSize
+		}
+	}
+	if err := client.validateContent(c, fd.PayloadType, suffix); err != nil {
+		log.Warnf("Uploading file %v aborted: %v", fd.SourceFilename, err)
+		return UploadResult{}, err
+	}
+	// The catalog and destination template describe the source content,
+	// whatever transformers make of it.
+	source := c
+	if len(client.settings.Transformers) > 0 {
+		var closer func()
+		var err error
+		c, suffix, closer, err = transform(c, suffix, client.settings.Transformers)
+		if err != nil {
+			return UploadResult{}, err
+		}
+		defer closer()
+		if t, ok := client.settings.Catalog.Lookup(fd.PayloadType); ok {
+			c.stream.limit = t.MaxSize
+		}
+		size = c.size
+	}
+	upload := UploadResult{
+		SourceFilename: fd.SourceFilename,
+		PayloadType:    fd.PayloadType,
+		Suffix:         suffix,
+		Size:           size,
+		SHA256:         c.sha256,
+		PartSize:       int64(partSize),
+		Parts:          partCount(size),
+		DryRun:         client.settings.DryRun,
+	}
+
+	var creds *credentials.APICredentials
+	retrieve := func() (credentials.APICredentials, error) {
+		if creds == nil {
+			cred, err := client.provider.Retrieve(ctx)
+			if err != nil {
+				return cred, fmt.Errorf("could not retrieve credentials: %v", err)
+			}
+			creds = &cred
+		}
+		return *creds, nil
+	}
+	destination, err := client.destination(fd, source, suffix, retrieve)
+	if err != nil {
+		return upload, err
 	}
+	upload.DestinationFilename = destination
 
-	result, err := getSAS(fd.PayloadType, fd.DestinationFilename, suffix, fd.CustomKey, fd.CustomValue, client.credentials, client.settings)
+	if client.settings.DryRun && !client.settings.DryRunRequestToken {
+		if err := c.drain(); err != nil {
+			return upload, err
+		}
+		c.update(&upload)
+		log.Infof("Dry run: would upload %v as %v, total %v in %v parts", fd.SourceFilename, fd.PayloadType, bytesize.ByteSize(size).String(), upload.Parts)
+		return upload, nil
+	}
+
+	cred, err := retrieve()
+	if err != nil {
+		return upload, err
+	}
+
+	api, err := NewAPIClient(client.settings, cred)
+	if err != nil {
+		return upload, err
+	}
+	defer api.Close()
+
+	tokenRequest := sas{fd.PayloadType, client.settings.Profile, suffix, destination, fd.CustomKey, fd.CustomValue, fd.Metadata}
+	result, err := api.requestToken(ctx, tokenRequest)
 	if err == ErrUnknownPayload {
 		log.Warnf("Uploading file %v aborted since payload %v is not supported", fd.SourceFilename, fd.PayloadType)
-		return err
+		return upload, err
 	}
 	if err != nil {
-		return fmt.Errorf("could not generate SAS token: %v", err)
+		return upload, fmt.Errorf("could not generate SAS token: %w", err)
 	}
-	if result.Type == "azure" {
-		log.Debugf("Got signed url for %v: %v", fd.SourceFilename, result.SASURL)
-		err := uploadToAzureSAS(fd.SourceFilename, result, client.settings)
-		if err != nil {
-			return err
+	upload.Backend = result.Type
+	upload.Key = result.Key
+	upload.BlobID = result.BlobID
+
+	if client.settings.DryRun {
+		if err := c.drain(); err != nil {
+			return upload, err
 		}
+		c.update(&upload)
+		// The token request created a multipart upload that will never be
+		// used, release it again.
+		if result.Type == "s3" {
+			if _, err := api.AbortMultipartUpload(ctx, result.Key, result.UploadId); err != nil {
+				return upload, err
+			}
+		}
+		log.Infof("Dry run: would upload %v to %v as %v, total %v in %v parts", fd.SourceFilename, result.Type, fd.PayloadType, bytesize.ByteSize(size).String(), upload.Parts)
+		return upload, nil
+	}
 
-	} else if result.Type == "s3" {
-		log.Debugf("Got signed url for %v: %v", fd.SourceFilename, result.Key)
-		var completeMultipartUpload completeMultipartUpload
-		var control = control{
-			EndpointWG:       &sync.WaitGroup{},
-			StopChan:         make(chan struct{}),
-			PartsChan:        make(chan interface{}),
-			HaltTransmitters: false,
+	if result.Type == "azure" {
+		log.Debugf("Got signed url for %v: %v", fd.SourceFilename, RedactURL(result.SASURL))
+		// An Azure upload is retried from the start, which a stream cannot
+		// be. Transformed files and byte slices are spooled so that they can;
+		// S3 parts are retried from memory and need no spool.
+		if len(client.settings.Transformers) > 0 && source.stream == nil {
+			spooled, release, err := spool(c, client.spoolDir(), source.path == "")
+			if err != nil {
+				return upload, err
+			}
+			defer release()
+			c = spooled
+			upload.Size, upload.SHA256, upload.Parts = c.size, c.sha256, partCount(c.size)
 		}
-		file, err := os.Open(fd.SourceFilename)
-		if err != nil {
-			return err
+		refresh := func(ctx context.Context) (sasResult, error) {
+			return api.requestToken(ctx, tokenRequest)
 		}
-		defer file.Close()
-		stat, err := file.Stat()
+		final, err := uploadToAzureSAS(ctx, client.httpClient, fd.SourceFilename, c, result, client.settings, refresh)
+		upload.BlobID = final.BlobID
 		if err != nil {
-			return err
+			return upload, err
 		}
-		fileSize := stat.Size()
-		log.Infof("Uploading file %v, total %v", fd.SourceFilename, bytesize.ByteSize(fileSize).String())
 
-		buffer := make([]byte, fileSize)
-		_, err = file.Read(buffer)
+	} else if result.Type == "s3" {
+		log.Debugf("Got signed url for %v: %v", fd.SourceFilename, result.Key)
+		r, closer, err := c.reader()
 		if err != nil {
-			return err
+			return upload, err
 		}
-
-		var start, currentSize int
-		var remaining = int(fileSize)
-		var partNum = 1
-		completeMultipartUpload.EventType = fd.PayloadType
-		completeMultipartUpload.Key = result.Key
-		completeMultipartUpload.UploadId = result.UploadId
-
-		// Create channel for chunks to handle
-		ChunkChan := make(chan transmitterPayload, partsTransmitterWorkers)
-		// Start workers
-		for i := 0; i < partsTransmitterWorkers; i++ {
-			//log.Infoln("Starting transmitter worker " + strconv.Itoa(i))
-			go partsTransmitter(ChunkChan, control)
+		defer closer()
+		if size >= 0 {
+			log.Infof("Uploading file %v, total %v", fd.SourceFilename, bytesize.ByteSize(size).String())
+		} else {
+			log.Infof("Uploading stream %v", fd.SourceFilename)
 		}
-		// Collect data from completed multiparts
-		go func() {
-			for {
-				select {
-				case partsOrErr := <-control.PartsChan:
-					if partsOrErr == nil {
-						control.EndpointWG.Done()
-					} else {
-						log.Debugf("  ... transfer part %v completed", partsOrErr.(parts).PartNumber)
-						completeMultipartUpload.Parts = append(completeMultipartUpload.Parts, partsOrErr.(parts))
-						control.EndpointWG.Done()
-					}
-				case <-control.StopChan:
-					// Job is done, exit function
-					return
-				}
-			}
-		}()
-
-		for start = 0; remaining > 0; start += partSize {
-			for {
-				if control.HaltTransmitters {
-					break
-				}
-				if len(ChunkChan) < partsTransmitterWorkers {
-					if remaining < partSize {
-						currentSize = remaining
-					} else {
-						currentSize = partSize
-					}
-					signedURL, err := getSignedURL(result, partNum, client.credentials)
-					if err != nil {
-						return err
-					}
-					control.EndpointWG.Add(1)
-					remaining -= currentSize
-					ChunkChan <- transmitterPayload{signedURL.SignedURL, bytes.NewReader(buffer[start : start+currentSize]), partNum, remaining}
-					partNum++
-					break
-				} else {
-					time.Sleep(100 * time.Millisecond)
-				}
-			}
 
+		hostname, _ := os.Hostname()
+		pending := PendingUpload{Key: result.Key, UploadId: result.UploadId, SourceFilename: fd.SourceFilename, PayloadType: fd.PayloadType, Started: time.Now().UTC(), Hostname: hostname, PID: os.Getpid()}
+		if err := client.journal.add(pending); err != nil {
+			log.Warnf("Could not record pending upload %v: %v", result.Key, err)
 		}
-		control.EndpointWG.Wait()
-		close(control.StopChan)
-		if control.HaltTransmitters {
-			result, err := abortMultipartUpload(result, client.credentials)
-			if err != nil {
-				return err
-			} else {
-				err := fmt.Errorf("%s", result.Message)
-				return err
-			}
-		} else {
-			sort.SliceStable(completeMultipartUpload.Parts, func(i, j int) bool {
-				return completeMultipartUpload.Parts[i].PartNumber < completeMultipartUpload.Parts[j].PartNumber
-			})
-			result, err := completeUpload(result, completeMultipartUpload.Parts, client.credentials)
-			if err != nil {
-				return err
-			} else {
-				log.Debugln(result.Message)
-				return nil
-			}
+		defer client.journal.done(result.Key)
+		if err := uploadToS3(ctx, api, client.httpClient, result, r, size, client.settings, client.journal); err != nil {
+			return upload, err
 		}
 
 	} else {
-		return fmt.Errorf("unknown result type: %v", result.Type)
+		return upload, fmt.Errorf("unknown result type: %v", result.Type)
 	}
 
-	return nil
+	c.update(&upload)
+	return upload, nil
 }
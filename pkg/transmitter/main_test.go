@@ -1,9 +1,14 @@
 package transmitter
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"strings"
 	"testing"
+
+	"github.com/SamuraiMDR/samurai-go/pkg/transmitter/transmittertest"
 )
 
 func TestValidateCustomKV(t *testing.T) {
@@ -51,3 +56,79 @@ func TestSASMarshalOmitsEmptyCustomFields(t *testing.T) {
 		t.Fatalf("expected custom fields present, got %s", body)
 	}
 }
+
+func TestValidateMetadata(t *testing.T) {
+	tooMany := map[string]string{}
+	for i := 0; i < maxMetadataPairs; i++ {
+		tooMany[strings.Repeat("k", i+1)] = "v"
+	}
+	cases := []struct {
+		name      string
+		metadata  map[string]string
+		customKey string
+		wantErr   bool
+	}{
+		{"nil is ok", nil, "", false},
+		{"valid pairs", map[string]string{"site": "oslo", "sensor": "edge"}, "", false},
+		{"valid pairs with custom key", map[string]string{"site": "oslo"}, "team", false},
+		{"max pairs", tooMany, "", false},
+		{"too many with custom key", tooMany, "team", true},
+		{"empty value", map[string]string{"site": ""}, "", true},
+		{"uppercase key", map[string]string{"Site": "oslo"}, "", true},
+		{"reserved key", map[string]string{"payload": "pcap"}, "", true},
+		{"reserved custom key", nil, "profile", true},
+		{"duplicate of custom key", map[string]string{"team": "red"}, "team", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := validateMetadata(c.metadata, c.customKey)
+			if (err != nil) != c.wantErr {
+				t.Fatalf("validateMetadata(%v, %q) error = %v, wantErr = %v", c.metadata, c.customKey, err, c.wantErr)
+			}
+		})
+	}
+}
+
+func TestSASMarshalMetadata(t *testing.T) {
+	body, err := json.Marshal(sas{Payload: "pcap", Profile: "s3", Suffix: "pcap", Filename: "f.pcap", Metadata: map[string]string{"site": "oslo"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), `"metadata":{"site":"oslo"}`) {
+		t.Fatalf("expected metadata present, got %s", body)
+	}
+	if strings.Contains(string(body), "customKey") {
+		t.Fatalf("expected custom fields omitted, got %s", body)
+	}
+}
+
+func TestSendFileDryRun(t *testing.T) {
+	withPartSize(t, 4)
+	data := []byte("0123456789")
+	path := writeTestFile(t, "capture.pcap", data)
+	sum := sha256.Sum256(data)
+
+	server, client := testServer(t, Settings{DryRun: true})
+	upload, err := client.SendFileContext(context.Background(), FileDetails{SourceFilename: path, PayloadType: "pcap"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !upload.DryRun || upload.Size != 10 || upload.Parts != 3 || upload.Suffix != "pcap" || upload.SHA256 != hex.EncodeToString(sum[:]) || upload.Backend != "" {
+		t.Fatalf("unexpected plan: %+v", upload)
+	}
+	if server.Requests(transmittertest.OpToken) != 0 {
+		t.Fatal("dry run must not contact the service")
+	}
+
+	server, client = testServer(t, Settings{DryRun: true, DryRunRequestToken: true})
+	upload, err = client.SendFileContext(context.Background(), FileDetails{SourceFilename: path, PayloadType: "pcap"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upload.Backend != "s3" || len(server.Aborted()) != 1 || len(server.Objects()) != 0 || server.Requests(transmittertest.OpPutPart) != 0 {
+		t.Fatalf("expected token request only, got %+v, aborted %v", upload, server.Aborted())
+	}
+	if _, err := client.SendFileContext(context.Background(), FileDetails{SourceFilename: path, PayloadType: "unknown"}); err != ErrUnknownPayload {
+		t.Fatalf("expected ErrUnknownPayload, got %v", err)
+	}
+}
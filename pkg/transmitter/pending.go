@@ -0,0 +1,281 @@
+/*
+ * NTT Security Holdings Go Library for Samurai
+ * Copyright 2023 NTT Security Holdings
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package transmitter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var ErrNoStateDir = errors.New("no state directory configured")
+
+// PendingUpload is an S3 multipart upload that was started but not yet
+// completed or aborted.
+type PendingUpload struct {
+	Key            string    `json:"key"`
+	UploadId       string    `json:"upload_id"`
+	SourceFilename string    `json:"source_filename"`
+	PayloadType    string    `json:"payload_type"`
+	Started        time.Time `json:"started"`
+	// Updated is refreshed each time a part of the upload completes.
+	Updated time.Time `json:"updated,omitempty"`
+	// Hostname and PID identify the process that started the upload.
+	Hostname string `json:"hostname,omitempty"`
+	PID      int    `json:"pid,omitempty"`
+}
+
+// lastActive returns when the upload last made progress.
+func (p PendingUpload) lastActive() time.Time {
+	if p.Updated.After(p.Started) {
+		return p.Updated
+	}
+	return p.Started
+}
+
+// uploadJournal records pending multipart uploads and uploads interrupted by
+// Shutdown in a directory, one file per record, so that they can be handled
+// after a restart. It also tracks which of them are in progress in this
+// process. A nil journal records nothing.
+type uploadJournal struct {
+	dir string
+
+	mu     sync.Mutex
+	active map[string]bool
+}
+
+const (
+	pendingPrefix = "upload-"
+	queuedPrefix  = "queued-"
+)
+
+func newUploadJournal(dir string) (*uploadJournal, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("could not create state directory: %v", err)
+	}
+	return &uploadJournal{dir: dir, active: make(map[string]bool)}, nil
+}
+
+// recordName returns the file name of the record of kind prefix for id.
+func recordName(prefix string, id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return prefix + hex.EncodeToString(sum[:16]) + ".json"
+}
+
+// write stores v as JSON under name, replacing the file atomically.
+func (j *uploadJournal) write(name string, v interface{}) error {
+	if j == nil {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(j.dir, ".record-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(j.dir, name))
+}
+
+// delete removes the record stored under name.
+func (j *uploadJournal) delete(name string) {
+	if j == nil {
+		return
+	}
+	if err := os.Remove(filepath.Join(j.dir, name)); err != nil && !os.IsNotExist(err) {
+		log.Warnf("Could not remove record %v: %v", name, err)
+	}
+}
+
+// read calls fn with the name and content of every record of kind prefix.
+// Unreadable records are skipped with a warning.
+func (j *uploadJournal) read(prefix string, fn func(name string, data []byte) error) error {
+	entries, err := os.ReadDir(j.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), prefix) || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(j.dir, entry.Name()))
+		if err != nil {
+			log.Warnf("Could not read record %v: %v", entry.Name(), err)
+			continue
+		}
+		if err := fn(entry.Name(), data); err != nil {
+			log.Warnf("Could not parse record %v: %v", entry.Name(), err)
+		}
+	}
+	return nil
+}
+
+// add records p as pending and in progress until done is called.
+func (j *uploadJournal) add(p PendingUpload) error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.active[p.Key] = true
+	return j.write(recordName(pendingPrefix, p.Key), p)
+}
+
+// touch refreshes Updated of the pending upload with key, so that other
+// processes see it is still in progress.
+func (j *uploadJournal) touch(key string) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	name := recordName(pendingPrefix, key)
+	data, err := os.ReadFile(filepath.Join(j.dir, name))
+	if err != nil {
+		return
+	}
+	var p PendingUpload
+	if err := json.Unmarshal(data, &p); err != nil {
+		return
+	}
+	p.Updated = time.Now().UTC()
+	if err := j.write(name, p); err != nil {
+		log.Warnf("Could not refresh pending upload %v: %v", key, err)
+	}
+}
+
+// done marks the upload with key as no longer in progress in this process.
+// Its record stays until it is removed.
+func (j *uploadJournal) done(key string) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	delete(j.active, key)
+}
+
+// inProgress reports whether the upload with key is running in this
+// process.
+func (j *uploadJournal) inProgress(key string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.active[key]
+}
+
+// remove forgets the pending upload with the given key.
+func (j *uploadJournal) remove(key string) {
+	j.delete(recordName(pendingPrefix, key))
+}
+
+// list returns the pending uploads, oldest first.
+func (j *uploadJournal) list() ([]PendingUpload, error) {
+	var pending []PendingUpload
+	err := j.read(pendingPrefix, func(name string, data []byte) error {
+		var p PendingUpload
+		if err := json.Unmarshal(data, &p); err != nil {
+			return err
+		}
+		pending = append(pending, p)
+		return nil
+	})
+	sort.Slice(pending, func(a, b int) bool { return pending[a].Started.Before(pending[b].Started) })
+	return pending, err
+}
+
+// PendingUploads returns the multipart uploads recorded in Settings.StateDir
+// that have not been completed or aborted, including those in progress.
+func (client Client) PendingUploads() ([]PendingUpload, error) {
+	if client.journal == nil {
+		return nil, ErrNoStateDir
+	}
+	return client.journal.list()
+}
+
+// CleanupStale aborts the multipart uploads recorded in Settings.StateDir
+// that have made no progress for more than olderThan, such as those left
+// behind when the process crashed, and returns the ones that were aborted.
+// An upload in progress refreshes its record as parts complete, so it is
+// kept as long as a part completes within olderThan; uploads in progress in
+// this client are always kept. Uploads that could not be aborted are kept
+// for the next cleanup and reported in the error.
+func (client Client) CleanupStale(ctx context.Context, olderThan time.Duration) ([]PendingUpload, error) {
+	pending, err := client.PendingUploads()
+	if err != nil {
+		return nil, err
+	}
+	var stale []PendingUpload
+	for _, p := range pending {
+		if !client.journal.inProgress(p.Key) && time.Since(p.lastActive()) > olderThan {
+			stale = append(stale, p)
+		}
+	}
+	if len(stale) == 0 {
+		return nil, nil
+	}
+
+	creds, err := client.provider.Retrieve(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve credentials: %v", err)
+	}
+	api, err := NewAPIClient(client.settings, creds)
+	if err != nil {
+		return nil, err
+	}
+	defer api.Close()
+
+	var aborted []PendingUpload
+	var errs []error
+	for _, p := range stale {
+		if _, err := api.AbortMultipartUpload(ctx, p.Key, p.UploadId); err != nil {
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+				errs = append(errs, fmt.Errorf("could not abort upload %v: %w", p.Key, err))
+				continue
+			}
+			// The service no longer knows the upload, nothing is left to abort.
+		}
+		log.Infof("Aborted stale upload %v of %v started %v", p.Key, p.SourceFilename, p.Started.Format(time.RFC3339))
+		client.journal.remove(p.Key)
+		aborted = append(aborted, p)
+	}
+	return aborted, errors.Join(errs...)
+}
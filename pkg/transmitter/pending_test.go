@@ -0,0 +1,137 @@
+package transmitter
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/SamuraiMDR/samurai-go/pkg/transmitter/transmittertest"
+)
+
+func TestCleanupStale(t *testing.T) {
+	server, client := testServer(t, Settings{StateDir: t.TempDir(), MaxRetries: 1})
+	path := writeTestFile(t, "file.pcap", []byte("data"))
+
+	if err := client.SendFile(FileDetails{SourceFilename: path, DestinationFilename: "done.pcap", PayloadType: "pcap"}); err != nil {
+		t.Fatal(err)
+	}
+	if pending, err := client.PendingUploads(); err != nil || len(pending) != 0 {
+		t.Fatalf("expected no pending uploads after success, got %v, %v", pending, err)
+	}
+
+	// The part and the abort fail, as if the process died mid-upload.
+	server.Inject(transmittertest.OpPutPart, 1, transmittertest.Fault{StatusCode: http.StatusInternalServerError})
+	server.Inject(transmittertest.OpAbortMultipart, 1, transmittertest.Fault{StatusCode: http.StatusInternalServerError})
+	if err := client.SendFile(FileDetails{SourceFilename: path, DestinationFilename: "orphan.pcap", PayloadType: "pcap"}); err == nil {
+		t.Fatal("expected upload error")
+	}
+	pending, err := client.PendingUploads()
+	if err != nil || len(pending) != 1 || pending[0].Key != "pcap/orphan.pcap" || pending[0].SourceFilename != path {
+		t.Fatalf("expected orphaned upload to be recorded, got %+v, %v", pending, err)
+	}
+
+	aborted, err := client.CleanupStale(context.Background(), time.Hour)
+	if err != nil || len(aborted) != 0 {
+		t.Fatalf("expected recent upload to be kept, got %v, %v", aborted, err)
+	}
+	aborted, err = client.CleanupStale(context.Background(), 0)
+	if err != nil || len(aborted) != 1 {
+		t.Fatalf("expected one aborted upload, got %v, %v", aborted, err)
+	}
+	if len(server.Pending()) != 0 || len(server.Aborted()) != 1 {
+		t.Fatalf("expected the service to have aborted the upload, pending %v", server.Pending())
+	}
+	if pending, _ := client.PendingUploads(); len(pending) != 0 {
+		t.Fatalf("expected record to be removed, got %v", pending)
+	}
+}
+
+func TestCleanupStaleKeepsFailedAborts(t *testing.T) {
+	server, client := testServer(t, Settings{StateDir: t.TempDir()})
+	for _, key := range []string{"pcap/first.pcap", "pcap/second.pcap"} {
+		// Recorded by a process that is gone.
+		if err := client.journal.write(recordName(pendingPrefix, key), PendingUpload{Key: key, UploadId: key, Started: time.Now().Add(-time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server.Inject(transmittertest.OpAbortMultipart, 1, transmittertest.Fault{StatusCode: http.StatusInternalServerError})
+
+	// The first abort fails, the second is for an upload the service does
+	// not know and counts as done.
+	aborted, err := client.CleanupStale(context.Background(), time.Minute)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || len(aborted) != 1 {
+		t.Fatalf("expected one abort and one APIError, got %v, %v", aborted, err)
+	}
+	if pending, _ := client.PendingUploads(); len(pending) != 1 {
+		t.Fatalf("expected the failed abort to be kept, got %v", pending)
+	}
+}
+
+func TestCleanupStaleKeepsLiveUploads(t *testing.T) {
+	_, client := testServer(t, Settings{StateDir: t.TempDir()})
+	started := time.Now().Add(-48 * time.Hour)
+	records := []struct {
+		key     string
+		updated time.Time
+		active  bool
+	}{
+		{"pcap/abandoned.pcap", time.Time{}, false},
+		{"pcap/progressing.pcap", time.Now(), false},
+		{"pcap/running.pcap", time.Time{}, true},
+	}
+	for _, r := range records {
+		p := PendingUpload{Key: r.key, UploadId: r.key, Started: started, Updated: r.updated}
+		if err := client.journal.write(recordName(pendingPrefix, r.key), p); err != nil {
+			t.Fatal(err)
+		}
+		if r.active {
+			client.journal.active[r.key] = true
+		}
+	}
+
+	aborted, err := client.CleanupStale(context.Background(), 24*time.Hour)
+	if err != nil || len(aborted) != 1 || aborted[0].Key != "pcap/abandoned.pcap" {
+		t.Fatalf("expected only the abandoned upload to be aborted, got %+v, %v", aborted, err)
+	}
+	if pending, _ := client.PendingUploads(); len(pending) != 2 {
+		t.Fatalf("expected the live uploads to be kept, got %+v", pending)
+	}
+}
+
+func TestSendFileRefreshesPendingUpload(t *testing.T) {
+	withPartSize(t, 2)
+	server, client := testServer(t, Settings{StateDir: t.TempDir(), MaxRetries: 1})
+	// The first part completes, the second fails after it and so does the
+	// abort.
+	server.Inject(transmittertest.OpPutPart, 1, transmittertest.Fault{})
+	server.Inject(transmittertest.OpPutPart, 1, transmittertest.Fault{StatusCode: http.StatusInternalServerError, Delay: 50 * time.Millisecond})
+	server.Inject(transmittertest.OpAbortMultipart, 1, transmittertest.Fault{StatusCode: http.StatusInternalServerError})
+	path := writeTestFile(t, "file.pcap", []byte("data"))
+
+	if err := client.SendFile(FileDetails{SourceFilename: path, DestinationFilename: "file.pcap", PayloadType: "pcap"}); err == nil {
+		t.Fatal("expected upload error")
+	}
+	pending, err := client.PendingUploads()
+	if err != nil || len(pending) != 1 {
+		t.Fatalf("expected one pending upload, got %+v, %v", pending, err)
+	}
+	hostname, _ := os.Hostname()
+	if p := pending[0]; p.Updated.IsZero() || p.Hostname != hostname || p.PID != os.Getpid() {
+		t.Fatalf("expected a refreshed record naming this process, got %+v", p)
+	}
+	// The failed upload is no longer in progress, so it can be cleaned up.
+	if aborted, err := client.CleanupStale(context.Background(), 0); err != nil || len(aborted) != 1 {
+		t.Fatalf("expected the failed upload to be aborted, got %v, %v", aborted, err)
+	}
+}
+
+func TestCleanupStaleWithoutStateDir(t *testing.T) {
+	_, client := testServer(t, Settings{})
+	if _, err := client.CleanupStale(context.Background(), 0); err != ErrNoStateDir {
+		t.Fatalf("expected ErrNoStateDir, got %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+/*
+ * NTT Security Holdings Go Library for Samurai
+ * Copyright 2023 NTT Security Holdings
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package transmitter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/SamuraiMDR/samurai-go/pkg/credentials"
+)
+
+// signatureParams are query parameters of Azure SAS and S3 presigned URLs
+// that grant access and must never be logged.
+var signatureParams = map[string]bool{
+	"sig":                  true,
+	"signature":            true,
+	"x-amz-signature":      true,
+	"x-amz-credential":     true,
+	"x-amz-security-token": true,
+	"awsaccesskeyid":       true,
+}
+
+// RedactURL returns rawURL with signatures, tokens and passwords replaced,
+// keeping enough of the URL (host, path, expiry) to be useful in logs.
+func RedactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return credentials.Redacted
+	}
+	query := u.Query()
+	for key := range query {
+		if signatureParams[strings.ToLower(key)] {
+			query.Set(key, "REDACTED")
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.Redacted()
+}
+
+// redactError hides signed URLs embedded in errors returned by http.Client.
+func redactError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return &url.Error{Op: urlErr.Op, URL: RedactURL(urlErr.URL), Err: urlErr.Err}
+	}
+	return err
+}
+
+func (r sasResult) String() string {
+	return fmt.Sprintf("{SASURL:%s Type:%s Key:%s UploadId:%s BlobID:%s}", RedactURL(r.SASURL), r.Type, r.Key, r.UploadId, r.BlobID)
+}
+
+func (r sasResult) GoString() string {
+	return "transmitter.sasResult" + r.String()
+}
+
+// MarshalJSON redacts the SAS URL so that JSON loggers do not print it.
+func (r sasResult) MarshalJSON() ([]byte, error) {
+	type plain sasResult
+	redacted := plain(r)
+	redacted.SASURL = RedactURL(r.SASURL)
+	return json.Marshal(redacted)
+}
+
+func (m signedURLMessage) String() string {
+	return fmt.Sprintf("{SignedURL:%s}", RedactURL(m.SignedURL))
+}
+
+func (m signedURLMessage) GoString() string {
+	return "transmitter.signedURLMessage" + m.String()
+}
+
+// MarshalJSON redacts the signed URL so that JSON loggers do not print it.
+func (m signedURLMessage) MarshalJSON() ([]byte, error) {
+	type plain signedURLMessage
+	redacted := plain(m)
+	redacted.SignedURL = RedactURL(m.SignedURL)
+	return json.Marshal(redacted)
+}
+
+func (p transmitterPayload) String() string {
+	return fmt.Sprintf("{signed_url:%s partNum:%d remaining:%d}", RedactURL(p.signed_url), p.partNum, p.remaining)
+}
+
+func (p transmitterPayload) GoString() string {
+	return "transmitter.transmitterPayload" + p.String()
+}
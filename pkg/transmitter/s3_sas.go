@@ -18,31 +18,47 @@ package transmitter
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
+	"sort"
+	"sync"
 	"time"
 
-	"github.com/SamuraiMDR/samurai-go/pkg/credentials"
 	"github.com/inhies/go-bytesize"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
 )
 
 var partSize = 100 * 1024 * 1024 // 5 Mb (5 Mb is AWS S3 minimum value)
 var partsTransmitterWorkers = 3
-var maxRetry = 3
 
-type parts struct {
+// storageTimeout bounds a single PUT of a part or blob to storage.
+const storageTimeout = 600 * time.Second
+
+// waitRetry sleeps attempt times backoff before a retry and returns early
+// with the context error when ctx ends.
+func waitRetry(ctx context.Context, backoff time.Duration, attempt int) error {
+	select {
+	case <-time.After(time.Duration(attempt) * backoff):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Part identifies an uploaded part of an S3 multipart upload.
+type Part struct {
 	ETag       string `json:"ETag"`
 	PartNumber int    `json:"PartNumber"`
 }
 
 type completeMultipartUpload struct {
-	EventType string  `json:"event_type"`
-	Key       string  `json:"key"`
-	UploadId  string  `json:"upload_id"`
-	Parts     []parts `json:"parts"`
+	EventType string `json:"event_type"`
+	Key       string `json:"key"`
+	UploadId  string `json:"upload_id"`
+	Parts     []Part `json:"parts"`
 }
 
 type completeMultipartUploadMessage struct {
@@ -72,145 +88,205 @@ type signedURLMessage struct {
 
 type transmitterPayload struct {
 	signed_url string
-	chunk      io.Reader
+	chunk      []byte
 	partNum    int
 	remaining  int
 }
 
-func sendRequest(body []byte, credentials credentials.APICredentials) ([]byte, error) {
-	HTTPClient := &http.Client{
-		Timeout: time.Second * 10,
-	}
-	defer HTTPClient.CloseIdleConnections()
-
-	request, err := http.NewRequest("POST", credentials.URL+"/cts/payload", bytes.NewBuffer(body))
-	if err != nil {
-		return nil, err
-	}
-	request.Header.Add("Content-Type", "application/json")
-	request.Header.Add("x-api-key", credentials.APIKey)
-	request.Header.Add("device_id", credentials.DeviceId)
-	request.Header.Add("deviceid", credentials.DeviceId)
-	request.Header.Add("passkey", credentials.Passkey)
-	for key, value := range credentials.ExtraHeaders {
-		request.Header.Add(key, value)
-	}
-
-	response, err := HTTPClient.Do(request)
-	if err != nil {
-		return nil, err
-	}
-	defer response.Body.Close()
-
-	bodyBytes, err := io.ReadAll(response.Body)
-	if err != nil {
-		return nil, err
+// partCount returns the number of parts an upload of size bytes is split
+// into. Empty files are sent as a single empty part.
+func partCount(size int64) int {
+	if size == 0 {
+		return 1
 	}
-
-	if response.StatusCode != 200 {
-		err := fmt.Errorf("status code: %d\n%v", response.StatusCode, string(bodyBytes))
-		return nil, err
-	}
-
-	return bodyBytes, nil
+	return int((size + int64(partSize) - 1) / int64(partSize))
 }
 
-func getSignedURL(partData sasResult, part int, credentials credentials.APICredentials) (signedURLMessage, error) {
-	var result signedURLMessage
-	body, err := json.Marshal(signedURL{"GET_SIGNED_URL", partData.Key, partData.UploadId, part})
-	if err != nil {
-		return result, err
-	}
-
-	bodyBytes, err := sendRequest(body, credentials)
-	if err != nil {
-		return result, err
-	}
-
-	err = json.Unmarshal(bodyBytes, &result)
-	if err != nil {
-		return result, err
+// uploadToS3 uploads r as an S3 multipart upload. One goroutine reads parts
+// from r and hands them to settings.SignedURLPrefetch goroutines that request
+// signed URLs concurrently and queue them for partsTransmitterWorkers
+// workers. A part is only read once one of partsTransmitterWorkers+prefetch
+// buffers is free, so that bounds the parts held in memory.
+// size is -1 when unknown. The first part that fails after all retries
+// cancels the others and the multipart upload is aborted. Once the upload is
+// completed or aborted it is removed from journal.
+func uploadToS3(ctx context.Context, api *APIClient, httpClient *http.Client, sr sasResult, r io.Reader, size int64, settings Settings, journal *uploadJournal) error {
+	var mu sync.Mutex
+	var completed []Part
+	prefetch := max(settings.SignedURLPrefetch, 1)
+	chunks := make(chan transmitterPayload)
+	chunkChan := make(chan transmitterPayload, prefetch)
+	// buffers holds a token for every part read and not yet uploaded.
+	buffers := make(chan struct{}, partsTransmitterWorkers+prefetch)
+	group, groupCtx := errgroup.WithContext(ctx)
+
+	group.Go(func() error {
+		defer close(chunks)
+		var read int64
+		for partNum := 1; ; partNum++ {
+			select {
+			case buffers <- struct{}{}:
+			case <-groupCtx.Done():
+				return groupCtx.Err()
+			}
+			var buffer bytes.Buffer
+			if size >= 0 {
+				buffer.Grow(int(min(int64(partSize), size-read)))
+			}
+			n, err := io.CopyN(&buffer, r, int64(partSize))
+			if err != nil && err != io.EOF {
+				return err
+			}
+			// An empty upload still needs one part.
+			if n == 0 && partNum > 1 {
+				return nil
+			}
+			read += n
+			remaining := int64(-1)
+			if size >= 0 {
+				remaining = size - read
+			}
+			select {
+			case chunks <- transmitterPayload{"", buffer.Bytes(), partNum, int(remaining)}:
+			case <-groupCtx.Done():
+				return groupCtx.Err()
+			}
+			if err == io.EOF {
+				return nil
+			}
+		}
+	})
+	var fetchers sync.WaitGroup
+	for i := 0; i < prefetch; i++ {
+		fetchers.Add(1)
+		group.Go(func() error {
+			defer fetchers.Done()
+			for part := range chunks {
+				signedURL, err := api.GetSignedURL(groupCtx, sr.Key, sr.UploadId, part.partNum)
+				if err != nil {
+					return err
+				}
+				part.signed_url = signedURL
+				select {
+				case chunkChan <- part:
+				case <-groupCtx.Done():
+					return groupCtx.Err()
+				}
+			}
+			return nil
+		})
 	}
-
-	return result, nil
-}
-
-func completeUpload(partData sasResult, parts []parts, credentials credentials.APICredentials) (completeMultipartUploadMessage, error) {
-	var result completeMultipartUploadMessage
-	body, err := json.Marshal(completeMultipartUpload{"COMPLETE_MULTIPART_UPLOAD", partData.Key, partData.UploadId, parts})
-	if err != nil {
-		return result, err
+	group.Go(func() error {
+		fetchers.Wait()
+		close(chunkChan)
+		return nil
+	})
+	for i := 0; i < partsTransmitterWorkers; i++ {
+		group.Go(func() error {
+			for part := range chunkChan {
+				refresh := func(ctx context.Context) (string, error) {
+					return api.GetSignedURL(ctx, sr.Key, sr.UploadId, part.partNum)
+				}
+				etag, err := partsTransmitter(groupCtx, httpClient, part, settings, refresh)
+				<-buffers
+				if err != nil {
+					return err
+				}
+				log.Debugf("  ... transfer part %v completed", part.partNum)
+				journal.touch(sr.Key)
+				mu.Lock()
+				completed = append(completed, Part{ETag: etag, PartNumber: part.partNum})
+				mu.Unlock()
+			}
+			return nil
+		})
 	}
 
-	bodyBytes, err := sendRequest(body, credentials)
-	if err != nil {
-		return result, err
+	if err := group.Wait(); err != nil {
+		// Abort even when ctx has ended, the upload is useless either way.
+		abortCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), apiTimeout)
+		defer cancel()
+		message, abortErr := api.AbortMultipartUpload(abortCtx, sr.Key, sr.UploadId)
+		if abortErr != nil {
+			return fmt.Errorf("%w, abort failed: %v", err, abortErr)
+		}
+		journal.remove(sr.Key)
+		return fmt.Errorf("%w: %s", err, message)
 	}
 
-	err = json.Unmarshal(bodyBytes, &result)
+	sort.Slice(completed, func(i, j int) bool { return completed[i].PartNumber < completed[j].PartNumber })
+	message, err := api.CompleteMultipartUpload(ctx, sr.Key, sr.UploadId, completed)
 	if err != nil {
-		return result, err
+		return err
 	}
-
-	return result, nil
+	journal.remove(sr.Key)
+	log.Debugln(message)
+	return nil
 }
 
-func abortMultipartUpload(partData sasResult, credentials credentials.APICredentials) (abortMultipartUploadMessage, error) {
-	var result abortMultipartUploadMessage
-	body, err := json.Marshal(abortedMultipartUpload{"ABORT_MULTIPART_UPLOAD", partData.Key, partData.UploadId})
-	if err != nil {
-		return result, err
-	}
-
-	bodyBytes, err := sendRequest(body, credentials)
-	if err != nil {
-		return result, err
+// partsTransmitter PUTs one part to its signed URL, trying up to
+// settings.MaxRetries times, and returns the ETag of the stored part. A URL
+// about to expire is replaced by one from refresh before use, and a URL
+// rejected as expired is replaced without using up a try.
+func partsTransmitter(ctx context.Context, httpClient *http.Client, part transmitterPayload, settings Settings, refresh func(context.Context) (string, error)) (string, error) {
+	refreshes := 0
+	refreshURL := func() error {
+		signedURL, err := refresh(ctx)
+		if err != nil {
+			return fmt.Errorf("could not refresh signed URL for part %v: %v", part.partNum, err)
+		}
+		refreshes++
+		part.signed_url = signedURL
+		return nil
 	}
-
-	err = json.Unmarshal(bodyBytes, &result)
-	if err != nil {
-		return result, err
+	if expiresSoon(part.signed_url) {
+		log.Infof("  ... signed URL for part %v is about to expire, refreshing", part.partNum)
+		if err := refreshURL(); err != nil {
+			return "", err
+		}
 	}
-
-	return result, nil
-}
-
-func partsTransmitter(ChunkChan <-chan transmitterPayload, control control) {
-	for part := range ChunkChan {
-		for i := 0; i <= maxRetry; i++ {
-			if i >= maxRetry {
-				log.Errorf("Aborting upload due to max retries for part %v has been reached", part.partNum)
-				control.HaltTransmitters = true
-			}
-
-			if control.HaltTransmitters {
-				control.PartsChan <- nil
-				return
-			}
-			if i == 0 {
+	for i := 0; i < settings.MaxRetries; i++ {
+		if i == 0 {
+			if part.remaining >= 0 {
 				log.Debugf("  ... transfer part %v started, %v remaning", part.partNum, bytesize.ByteSize(part.remaining).String())
 			} else {
-				log.Warnf("  ... resending part %v, try %v \n", part.partNum, i)
+				log.Debugf("  ... transfer part %v started", part.partNum)
 			}
-			parts := parts{}
-			HTTPClient := &http.Client{Timeout: time.Second * 600}
-
-			request, err := http.NewRequest(http.MethodPut, part.signed_url, part.chunk)
-			if err != nil {
-				log.Errorln(err)
-				HTTPClient.CloseIdleConnections()
-				continue
+		} else {
+			if err := waitRetry(ctx, settings.RetryBackoff, i); err != nil {
+				return "", err
 			}
-			response, err := HTTPClient.Do(request)
-			if err != nil {
-				log.Errorln(err)
-				HTTPClient.CloseIdleConnections()
-				continue
+			log.Warnf("  ... resending part %v, try %v \n", part.partNum, i)
+		}
+		request, err := http.NewRequestWithContext(ctx, http.MethodPut, part.signed_url, bytes.NewReader(part.chunk))
+		if err != nil {
+			return "", err
+		}
+		response, err := httpClient.Do(request)
+		if err != nil {
+			if ctx.Err() != nil {
+				return "", ctx.Err()
 			}
-			parts.ETag = response.Header.Get("ETag")
-			parts.PartNumber = part.partNum
-			control.PartsChan <- parts
-			break
+			log.Errorln(redactError(err))
+			continue
+		}
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 4096))
+		io.Copy(io.Discard, response.Body)
+		response.Body.Close()
+		if isExpiredS3Response(response.StatusCode, body) && refreshes < maxSignatureRefreshes {
+			log.Warnf("  ... signed URL for part %v has expired, refreshing", part.partNum)
+			if err := refreshURL(); err != nil {
+				return "", err
+			}
+			i--
+			continue
+		}
+		if response.StatusCode != http.StatusOK {
+			log.Errorf("Part %v rejected with status code %v", part.partNum, response.StatusCode)
+			continue
 		}
+		return response.Header.Get("ETag"), nil
 	}
+	log.Errorf("Aborting upload due to max retries for part %v has been reached", part.partNum)
+	return "", fmt.Errorf("max retries for part %v has been reached", part.partNum)
 }
@@ -0,0 +1,234 @@
+package transmitter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SamuraiMDR/samurai-go/pkg/transmitter/transmittertest"
+)
+
+func withPartSize(t *testing.T, size int) {
+	previous := partSize
+	partSize = size
+	t.Cleanup(func() { partSize = previous })
+}
+
+// testServer starts a mock payload service and a client for it. Retries
+// back off by a millisecond so failure paths run quickly.
+func testServer(t *testing.T, settings Settings) (*transmittertest.Server, Client) {
+	return testServerWithOptions(t, transmittertest.Options{}, settings)
+}
+
+func testServerWithOptions(t *testing.T, opts transmittertest.Options, settings Settings) (*transmittertest.Server, Client) {
+	server := transmittertest.NewServer(opts)
+	t.Cleanup(server.Close)
+	settings.RetryBackoff = time.Millisecond
+	client, err := NewClient(settings, server.Credentials())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, client
+}
+
+func writeTestFile(t *testing.T, name string, data []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSendFileConcurrent(t *testing.T) {
+	withPartSize(t, 7)
+	server, client := testServer(t, Settings{})
+
+	dir := t.TempDir()
+	contents := map[string][]byte{}
+	for i := 0; i < 8; i++ {
+		name := fmt.Sprintf("file%d.pcap", i)
+		contents[name] = bytes.Repeat([]byte{byte('a' + i)}, 10*i+3)
+		if err := os.WriteFile(filepath.Join(dir, name), contents[name], 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(contents))
+	for name := range contents {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			errs <- client.SendFile(FileDetails{SourceFilename: filepath.Join(dir, name), DestinationFilename: name, PayloadType: "pcap"})
+		}(name)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, content := range contents {
+		object, ok := server.Object("pcap/" + name)
+		if !ok || !bytes.Equal(object.Data, content) {
+			t.Fatalf("object %s does not match source file", name)
+		}
+	}
+}
+
+func TestSendFileAbortsOnFailedPart(t *testing.T) {
+	withPartSize(t, 4)
+	server, client := testServer(t, Settings{})
+	server.Inject(transmittertest.OpPutPart, 0, transmittertest.Fault{StatusCode: http.StatusInternalServerError})
+
+	name := writeTestFile(t, "file.pcap", []byte("0123456789abcdef"))
+	if err := client.SendFile(FileDetails{SourceFilename: name, PayloadType: "pcap"}); err == nil {
+		t.Fatal("expected error")
+	}
+	if len(server.Aborted()) != 1 || len(server.Objects()) != 0 {
+		t.Fatalf("expected upload to be aborted, aborted %v, objects %d", server.Aborted(), len(server.Objects()))
+	}
+}
+
+func TestSendFileS3RetriesTransientFaults(t *testing.T) {
+	withPartSize(t, 4)
+	transport := &transmittertest.FaultTransport{
+		Match: transmittertest.MatchRequest(http.MethodPut, "/s3/"),
+		Script: []transmittertest.TransportFault{
+			{Drop: true},
+			{StatusCode: http.StatusTooManyRequests},
+			{StatusCode: http.StatusServiceUnavailable},
+			{DropResponse: true},
+		},
+	}
+	server, client := testServer(t, Settings{Transport: transport, MaxRetries: 5})
+	data := []byte("0123456789abcdef")
+
+	if err := client.SendFile(FileDetails{SourceFilename: writeTestFile(t, "file.pcap", data), DestinationFilename: "file.pcap", PayloadType: "pcap"}); err != nil {
+		t.Fatal(err)
+	}
+	object, ok := server.Object("pcap/file.pcap")
+	if !ok || !bytes.Equal(object.Data, data) || transport.Faults() != 4 {
+		t.Fatalf("expected complete object after %d faults, got %q", transport.Faults(), object.Data)
+	}
+}
+
+func TestSendFileS3GivesUpAfterMaxRetries(t *testing.T) {
+	transport := &transmittertest.FaultTransport{
+		Match:       transmittertest.MatchRequest(http.MethodPut, "/s3/"),
+		Fault:       transmittertest.TransportFault{StatusCode: http.StatusInternalServerError},
+		Probability: 1,
+	}
+	server, client := testServer(t, Settings{Transport: transport})
+
+	if err := client.SendFile(FileDetails{SourceFilename: writeTestFile(t, "file.pcap", []byte("data")), PayloadType: "pcap"}); err == nil {
+		t.Fatal("expected error")
+	}
+	if transport.Faults() != 3 || len(server.Aborted()) != 1 {
+		t.Fatalf("expected 3 tries and an abort, got %d tries, aborted %v", transport.Faults(), server.Aborted())
+	}
+}
+
+// concurrencyTransport records the highest number of concurrent requests to
+// the payload API.
+type concurrencyTransport struct {
+	mu      sync.Mutex
+	current int
+	highest int
+}
+
+func (c *concurrencyTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Path != "/cts/payload" {
+		return http.DefaultTransport.RoundTrip(r)
+	}
+	c.mu.Lock()
+	c.current++
+	c.highest = max(c.highest, c.current)
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.current--
+		c.mu.Unlock()
+	}()
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestSendFileS3PrefetchesSignedURLs(t *testing.T) {
+	withPartSize(t, 2)
+	transport := &concurrencyTransport{}
+	server, client := testServer(t, Settings{Transport: transport, SignedURLPrefetch: 4})
+	server.Inject(transmittertest.OpGetSignedURL, 0, transmittertest.Fault{Delay: 20 * time.Millisecond})
+	data := []byte("0123456789abcdefghij")
+
+	if err := client.SendFile(FileDetails{SourceFilename: writeTestFile(t, "file.pcap", data), DestinationFilename: "file.pcap", PayloadType: "pcap"}); err != nil {
+		t.Fatal(err)
+	}
+	object, ok := server.Object("pcap/file.pcap")
+	if !ok || !bytes.Equal(object.Data, data) {
+		t.Fatalf("expected complete object, got %q", object.Data)
+	}
+	if transport.highest < 2 || transport.highest > 4 {
+		t.Fatalf("expected between 2 and 4 concurrent signed URL requests, got %d", transport.highest)
+	}
+}
+
+// heldPartsTransport counts S3 part uploads that have completed, and
+// heldPartsReader records the most parts read but not yet uploaded.
+type heldPartsTransport struct {
+	mu        sync.Mutex
+	completed int
+}
+
+func (h *heldPartsTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	response, err := http.DefaultTransport.RoundTrip(r)
+	if r.Method == http.MethodPut {
+		h.mu.Lock()
+		h.completed++
+		h.mu.Unlock()
+	}
+	return response, err
+}
+
+type heldPartsReader struct {
+	r         io.Reader
+	transport *heldPartsTransport
+	read      int
+	highest   int
+}
+
+func (h *heldPartsReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.read += n
+	h.transport.mu.Lock()
+	h.highest = max(h.highest, (h.read+partSize-1)/partSize-h.transport.completed)
+	h.transport.mu.Unlock()
+	return n, err
+}
+
+func TestSendReaderS3BoundsPartBuffers(t *testing.T) {
+	withPartSize(t, 2)
+	transport := &heldPartsTransport{}
+	server, client := testServer(t, Settings{Transport: transport, SignedURLPrefetch: 1})
+	server.Inject(transmittertest.OpPutPart, 0, transmittertest.Fault{Delay: 5 * time.Millisecond})
+	data := bytes.Repeat([]byte("0123456789"), 4)
+	reader := &heldPartsReader{r: bytes.NewReader(data), transport: transport}
+
+	if _, err := client.SendReaderContext(context.Background(), reader, -1, FileDetails{FileSuffix: "pcap", DestinationFilename: "file.pcap", PayloadType: "pcap"}); err != nil {
+		t.Fatal(err)
+	}
+	if object, ok := server.Object("pcap/file.pcap"); !ok || !bytes.Equal(object.Data, data) {
+		t.Fatalf("expected complete object, got %q", object.Data)
+	}
+	if limit := partsTransmitterWorkers + 1; reader.highest > limit {
+		t.Fatalf("expected at most %d parts in memory, got %d", limit, reader.highest)
+	}
+}
@@ -0,0 +1,203 @@
+/*
+ * NTT Security Holdings Go Library for Samurai
+ * Copyright 2023 NTT Security Holdings
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package transmitter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var ErrShutdown = errors.New("client is shut down")
+
+// lifecycle tracks the uploads in flight so that Shutdown can wait for them
+// and cancel them at its deadline. It is shared by all copies of a Client.
+type lifecycle struct {
+	mu       sync.Mutex
+	closed   bool
+	inflight sync.WaitGroup
+	// ctx is cancelled when Shutdown gives up waiting.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newLifecycle() *lifecycle {
+	l := &lifecycle{}
+	l.ctx, l.cancel = context.WithCancel(context.Background())
+	return l
+}
+
+// begin registers an upload and returns its context, which also ends when
+// Shutdown cancels uploads. done must be called when the upload returns.
+func (l *lifecycle) begin(ctx context.Context) (context.Context, func(), error) {
+	if l == nil {
+		return ctx, func() {}, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil, nil, ErrShutdown
+	}
+	l.inflight.Add(1)
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(l.ctx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+		l.inflight.Done()
+	}, nil
+}
+
+// interrupted reports whether Shutdown has cancelled uploads.
+func (l *lifecycle) interrupted() bool {
+	return l != nil && l.ctx.Err() != nil
+}
+
+// Shutdown stops the client from accepting new uploads and waits for the
+// uploads in flight until ctx ends. It then cancels the remaining uploads,
+// which aborts their S3 multipart uploads, and records them in
+// Settings.StateDir so that SendQueued can send them after a restart. The
+// error is nil when all uploads finished in time. Shutdown affects all copies
+// of the client.
+func (client Client) Shutdown(ctx context.Context) error {
+	l := client.lifecycle
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	l.closed = true
+	l.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		l.inflight.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+	}
+	log.Warnf("Shutdown deadline reached, cancelling uploads in progress")
+	l.cancel()
+	<-finished
+	return fmt.Errorf("uploads in progress were cancelled: %w", ctx.Err())
+}
+
+// ShutdownOnSignal returns a context that ends when the process receives
+// SIGINT or SIGTERM, or when parent ends, so that callers stop submitting
+// uploads. The client is then shut down, giving uploads in flight grace to
+// finish; wait blocks until that is done and returns the Shutdown error. A
+// second signal terminates the process as usual.
+//
+// The context only gates new submissions: do not pass it to uploads, or the
+// signal cancels them at once instead of after grace, and they are neither
+// waited for nor queued.
+func (client Client) ShutdownOnSignal(parent context.Context, grace time.Duration) (ctx context.Context, wait func() error) {
+	ctx, stop := signal.NotifyContext(parent, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	var err error
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+		stop()
+		log.Infof("Shutting down, waiting up to %v for uploads in progress", grace)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), grace)
+		defer cancel()
+		err = client.Shutdown(shutdownCtx)
+	}()
+	return ctx, func() error {
+		<-done
+		return err
+	}
+}
+
+// QueuedUpload is an upload that was cancelled by Shutdown.
+type QueuedUpload struct {
+	FileDetails FileDetails `json:"file_details"`
+	Queued      time.Time   `json:"queued"`
+}
+
+func queuedName(fd FileDetails) string {
+	return recordName(queuedPrefix, fd.SourceFilename+"\x00"+fd.DestinationFilename+"\x00"+fd.PayloadType)
+}
+
+// queue records an upload cancelled by Shutdown.
+func (client Client) queue(fd FileDetails) {
+	if client.journal == nil {
+		log.Warnf("Upload of %v was cancelled by shutdown and is not queued, no state directory configured", fd.SourceFilename)
+		return
+	}
+	if err := client.journal.write(queuedName(fd), QueuedUpload{FileDetails: fd, Queued: time.Now().UTC()}); err != nil {
+		log.Errorf("Could not queue upload of %v: %v", fd.SourceFilename, err)
+		return
+	}
+	log.Infof("Upload of %v was cancelled by shutdown and has been queued", fd.SourceFilename)
+}
+
+// QueuedUploads returns the uploads cancelled by Shutdown and recorded in
+// Settings.StateDir, oldest first.
+func (client Client) QueuedUploads() ([]QueuedUpload, error) {
+	if client.journal == nil {
+		return nil, ErrNoStateDir
+	}
+	var queued []QueuedUpload
+	err := client.journal.read(queuedPrefix, func(name string, data []byte) error {
+		var q QueuedUpload
+		if err := json.Unmarshal(data, &q); err != nil {
+			return err
+		}
+		queued = append(queued, q)
+		return nil
+	})
+	sort.Slice(queued, func(a, b int) bool { return queued[a].Queued.Before(queued[b].Queued) })
+	return queued, err
+}
+
+// SendQueued sends the uploads returned by QueuedUploads and removes the
+// ones that were sent, or that no longer need sending because the source
+// file is gone or the destination exists. The others stay queued and are
+// reported in the error.
+func (client Client) SendQueued(ctx context.Context) error {
+	queued, err := client.QueuedUploads()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, q := range queued {
+		_, err := client.SendFileContext(ctx, q.FileDetails)
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrFileExists) || errors.Is(err, os.ErrNotExist):
+			log.Warnf("Dropping queued upload of %v: %v", q.FileDetails.SourceFilename, err)
+		default:
+			errs = append(errs, fmt.Errorf("%v: %w", q.FileDetails.SourceFilename, err))
+			continue
+		}
+		client.journal.delete(queuedName(q.FileDetails))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,144 @@
+package transmitter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/SamuraiMDR/samurai-go/pkg/transmitter/transmittertest"
+)
+
+// startUpload runs SendFile in the background and returns its result channel
+// once the upload has requested a part URL.
+func startUpload(t *testing.T, server *transmittertest.Server, client Client, fd FileDetails) chan error {
+	result := make(chan error, 1)
+	go func() { result <- client.SendFile(fd) }()
+	for server.Requests(transmittertest.OpGetSignedURL) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	return result
+}
+
+func TestShutdownWaitsForUploads(t *testing.T) {
+	transport := &transmittertest.FaultTransport{
+		Match:  transmittertest.MatchRequest(http.MethodPut, "/s3/"),
+		Script: []transmittertest.TransportFault{{Delay: 100 * time.Millisecond}},
+	}
+	server, client := testServer(t, Settings{Transport: transport})
+	data := []byte("data")
+	path := writeTestFile(t, "file.pcap", data)
+	result := startUpload(t, server, client, FileDetails{SourceFilename: path, DestinationFilename: "file.pcap", PayloadType: "pcap"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-result; err != nil {
+		t.Fatalf("in-flight upload failed: %v", err)
+	}
+	if object, ok := server.Object("pcap/file.pcap"); !ok || !bytes.Equal(object.Data, data) {
+		t.Fatal("expected in-flight upload to complete")
+	}
+	if err := client.SendFile(FileDetails{SourceFilename: path, PayloadType: "pcap"}); err != ErrShutdown {
+		t.Fatalf("expected ErrShutdown, got %v", err)
+	}
+}
+
+func TestShutdownCancelsAndQueuesUploads(t *testing.T) {
+	stateDir := t.TempDir()
+	transport := &transmittertest.FaultTransport{
+		Match:  transmittertest.MatchRequest(http.MethodPut, "/s3/"),
+		Script: []transmittertest.TransportFault{{Delay: time.Minute}},
+	}
+	server, client := testServer(t, Settings{Transport: transport, StateDir: stateDir})
+	data := []byte("data")
+	fd := FileDetails{SourceFilename: writeTestFile(t, "file.pcap", data), DestinationFilename: "file.pcap", PayloadType: "pcap"}
+	result := startUpload(t, server, client, fd)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := client.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+	if err := <-result; err == nil {
+		t.Fatal("expected cancelled upload to fail")
+	}
+	if len(server.Aborted()) != 1 || len(server.Pending()) != 0 {
+		t.Fatalf("expected the multipart upload to be aborted, aborted %v, pending %v", server.Aborted(), server.Pending())
+	}
+
+	// A new client, as after a restart, sends the queued upload.
+	restarted, err := NewClient(Settings{StateDir: stateDir, RetryBackoff: time.Millisecond}, server.Credentials())
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued, err := restarted.QueuedUploads()
+	if err != nil || len(queued) != 1 || queued[0].FileDetails.SourceFilename != fd.SourceFilename {
+		t.Fatalf("expected the cancelled upload to be queued, got %+v, %v", queued, err)
+	}
+	if err := restarted.SendQueued(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if object, ok := server.Object("pcap/file.pcap"); !ok || !bytes.Equal(object.Data, data) {
+		t.Fatal("expected queued upload to be sent")
+	}
+	if queued, _ := restarted.QueuedUploads(); len(queued) != 0 {
+		t.Fatalf("expected empty queue, got %+v", queued)
+	}
+	if pending, _ := restarted.PendingUploads(); len(pending) != 0 {
+		t.Fatalf("expected no pending uploads, got %+v", pending)
+	}
+}
+
+func TestShutdownOnSignalParentCancel(t *testing.T) {
+	_, client := testServer(t, Settings{})
+	parent, cancel := context.WithCancel(context.Background())
+	ctx, wait := client.ShutdownOnSignal(parent, time.Second)
+	cancel()
+	<-ctx.Done()
+	if err := wait(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SendFile(FileDetails{SourceFilename: "file.pcap", PayloadType: "pcap"}); err != ErrShutdown {
+		t.Fatalf("expected ErrShutdown, got %v", err)
+	}
+}
+
+func TestShutdownOnSignalLetsUploadsFinish(t *testing.T) {
+	transport := &transmittertest.FaultTransport{
+		Match:  transmittertest.MatchRequest(http.MethodPut, "/s3/"),
+		Script: []transmittertest.TransportFault{{Delay: 300 * time.Millisecond}},
+	}
+	server, client := testServer(t, Settings{Transport: transport, StateDir: t.TempDir()})
+	data := []byte("data")
+	path := writeTestFile(t, "file.pcap", data)
+	ctx, wait := client.ShutdownOnSignal(context.Background(), 5*time.Second)
+	// The upload does not use ctx, the signal only stops new uploads.
+	result := startUpload(t, server, client, FileDetails{SourceFilename: path, DestinationFilename: "file.pcap", PayloadType: "pcap"})
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	<-ctx.Done()
+	if err := wait(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-result; err != nil {
+		t.Fatalf("in-flight upload failed: %v", err)
+	}
+	if object, ok := server.Object("pcap/file.pcap"); !ok || !bytes.Equal(object.Data, data) {
+		t.Fatal("expected in-flight upload to complete")
+	}
+	if queued, _ := client.QueuedUploads(); len(queued) != 0 {
+		t.Fatalf("expected nothing queued, got %+v", queued)
+	}
+	if err := client.SendFile(FileDetails{SourceFilename: path, PayloadType: "pcap"}); err != ErrShutdown {
+		t.Fatalf("expected ErrShutdown, got %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+/*
+ * NTT Security Holdings Go Library for Samurai
+ * Copyright 2023 NTT Security Holdings
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package transmitter
+
+import (
+	"compress/gzip"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+// SuffixChange is the file suffix of transformed content, or empty when a
+// Transformer keeps the suffix.
+type SuffixChange string
+
+// Transformer rewrites content between the source and storage, for example
+// to compress, encrypt or redact it. Wrap returns a reader of the
+// transformed content; if it is an io.Closer it is closed after the upload.
+type Transformer interface {
+	Wrap(r io.Reader) (io.Reader, SuffixChange)
+}
+
+// TransformerFunc adapts a function to a Transformer.
+type TransformerFunc func(r io.Reader) (io.Reader, SuffixChange)
+
+func (f TransformerFunc) Wrap(r io.Reader) (io.Reader, SuffixChange) {
+	return f(r)
+}
+
+// transform applies transformers in order to c and returns the result as a
+// stream with its suffix. Its size and checksum are only known once it has
+// been read. The returned function closes the readers.
+func transform(c *content, suffix string, transformers []Transformer) (*content, string, func(), error) {
+	r, closer, err := c.reader()
+	if err != nil {
+		return nil, "", nil, err
+	}
+	closers := []func(){closer}
+	for _, transformer := range transformers {
+		var change SuffixChange
+		r, change = transformer.Wrap(r)
+		if change != "" {
+			suffix = string(change)
+		}
+		if rc, ok := r.(io.Closer); ok {
+			closers = append(closers, func() { rc.Close() })
+		}
+	}
+	closeAll := func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			closers[i]()
+		}
+	}
+	return streamContent(r, -1), suffix, closeAll, nil
+}
+
+// spool reads the transformed stream c into memory, or into a temporary
+// file in dir when inMemory is false, so that an upload that cannot retry
+// from a stream can send it again. The returned function removes the file.
+func spool(c *content, dir string, inMemory bool) (*content, func(), error) {
+	if inMemory {
+		data, err := io.ReadAll(c.stream)
+		if err != nil {
+			return nil, nil, err
+		}
+		spooled := bytesContent(data)
+		return spooled, func() {}, spooled.measure()
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, nil, fmt.Errorf("could not create spool directory: %v", err)
+		}
+	}
+	file, err := os.CreateTemp(dir, ".spool-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = io.Copy(file, c.stream)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return nil, nil, fmt.Errorf("could not spool transformed content: %w", err)
+	}
+	// The stream hashed and counted what it read.
+	spooled := &content{path: file.Name(), size: c.stream.n, sha256: hex.EncodeToString(c.stream.hash.Sum(nil))}
+	return spooled, func() { os.Remove(spooled.path) }, nil
+}
+
+// GzipTransformer compresses content and changes its suffix to "gz".
+type GzipTransformer struct {
+	// Level is a compress/gzip level, default gzip.DefaultCompression.
+	Level int
+}
+
+func (g GzipTransformer) Wrap(r io.Reader) (io.Reader, SuffixChange) {
+	level := g.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		zw, err := gzip.NewWriterLevel(pw, level)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err = io.Copy(zw, r); err == nil {
+			err = zw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, "gz"
+}
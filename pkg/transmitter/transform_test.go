@@ -0,0 +1,192 @@
+package transmitter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SamuraiMDR/samurai-go/pkg/transmitter/transmittertest"
+)
+
+// upperTransformer upper-cases content and keeps its suffix.
+var upperTransformer = TransformerFunc(func(r io.Reader) (io.Reader, SuffixChange) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return r, ""
+	}
+	return bytes.NewReader(bytes.ToUpper(data)), ""
+})
+
+func gunzip(t *testing.T, data []byte) []byte {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plain
+}
+
+func TestSendFileTransformers(t *testing.T) {
+	data := []byte(strings.Repeat("log line\n", 100))
+	for _, profile := range []string{"default", "azure"} {
+		t.Run(profile, func(t *testing.T) {
+			withPartSize(t, 16)
+			server, client := testServer(t, Settings{Profile: profile, Transformers: []Transformer{upperTransformer, GzipTransformer{}}})
+			path := writeTestFile(t, "file.log", data)
+
+			upload, err := client.SendFileContext(context.Background(), FileDetails{SourceFilename: path, DestinationFilename: "file.log.gz", PayloadType: "logs"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			object, ok := server.Object("logs/file.log.gz")
+			if !ok {
+				t.Fatalf("expected object, got %v", server.Objects())
+			}
+			if plain := gunzip(t, object.Data); !bytes.Equal(plain, bytes.ToUpper(data)) {
+				t.Fatalf("unexpected content %q", plain)
+			}
+			if upload.Suffix != "gz" || upload.Size != int64(len(object.Data)) || upload.SHA256 != sha256Hex(object.Data) {
+				t.Fatalf("expected result for transformed content, got %+v", upload)
+			}
+		})
+	}
+}
+
+func TestSendFileTransformerDryRun(t *testing.T) {
+	server, client := testServer(t, Settings{DryRun: true, Transformers: []Transformer{GzipTransformer{}}})
+	path := writeTestFile(t, "file.log", []byte("data"))
+
+	upload, err := client.SendFileContext(context.Background(), FileDetails{SourceFilename: path, PayloadType: "logs"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upload.Size <= 0 || upload.SHA256 == "" || len(server.Objects()) != 0 {
+		t.Fatalf("expected measured dry run without objects, got %+v", upload)
+	}
+}
+
+func TestSendFileTransformerCatalog(t *testing.T) {
+	cases := []struct {
+		name     string
+		filename string
+		payload  string
+		err      error
+	}{
+		{"pcap", "file.pcap", "pcap", nil},
+		{"bouncer", "alert.json", "bouncer", nil},
+		// The source suffix is checked, not the one of the stored object.
+		{"wrong source suffix", "alert.txt", "bouncer", ErrSuffixNotAllowed},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			server, client := testServer(t, Settings{Catalog: DefaultCatalog(), Transformers: []Transformer{GzipTransformer{}}})
+			path := writeTestFile(t, c.filename, []byte("{}"))
+
+			_, err := client.SendFileContext(context.Background(), FileDetails{SourceFilename: path, DestinationFilename: "file.gz", PayloadType: c.payload})
+			if !errors.Is(err, c.err) {
+				t.Fatalf("expected %v, got %v", c.err, err)
+			}
+			if _, ok := server.Object(c.payload + "/file.gz"); ok != (c.err == nil) {
+				t.Fatalf("unexpected objects %v", server.Objects())
+			}
+		})
+	}
+}
+
+func TestSendFileTransformerDestinationChecksum(t *testing.T) {
+	server, client := testServer(t, Settings{DestinationTemplate: `{{.SHA256}}.{{.Suffix}}`, Transformers: []Transformer{GzipTransformer{}}})
+	data := []byte("data")
+	path := writeTestFile(t, "file.log", data)
+
+	upload, err := client.SendFileContext(context.Background(), FileDetails{SourceFilename: path, PayloadType: "logs"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The template names the source content, the result the stored object.
+	expected := sha256Hex(data) + ".gz"
+	object, ok := server.Object("logs/" + expected)
+	if !ok || upload.DestinationFilename != expected {
+		t.Fatalf("expected object logs/%s, got %q", expected, upload.DestinationFilename)
+	}
+	if upload.SHA256 != sha256Hex(object.Data) {
+		t.Fatalf("expected checksum of stored object, got %s", upload.SHA256)
+	}
+}
+
+func TestSendTransformerAzureRetry(t *testing.T) {
+	data := []byte(strings.Repeat("log line\n", 10))
+	send := map[string]func(Client, string) (UploadResult, error){
+		"file": func(client Client, path string) (UploadResult, error) {
+			return client.SendFileContext(context.Background(), FileDetails{SourceFilename: path, DestinationFilename: "file.log.gz", PayloadType: "logs"})
+		},
+		"bytes": func(client Client, path string) (UploadResult, error) {
+			return client.SendBytesContext(context.Background(), data, FileDetails{SourceFilename: path, DestinationFilename: "file.log.gz", PayloadType: "logs"})
+		},
+	}
+	for name, send := range send {
+		t.Run(name, func(t *testing.T) {
+			server, client := testServer(t, Settings{Profile: "azure", Transformers: []Transformer{GzipTransformer{}}})
+			server.Inject(transmittertest.OpPutBlob, 1, transmittertest.Fault{StatusCode: http.StatusInternalServerError})
+			path := writeTestFile(t, "file.log", data)
+
+			if _, err := send(client, path); err != nil {
+				t.Fatal(err)
+			}
+			object, ok := server.Object("logs/file.log.gz")
+			if !ok || !bytes.Equal(gunzip(t, object.Data), data) {
+				t.Fatalf("expected retried object, got %v", server.Objects())
+			}
+			if server.Requests(transmittertest.OpPutBlob) != 2 {
+				t.Fatalf("expected 2 blob uploads, got %d", server.Requests(transmittertest.OpPutBlob))
+			}
+		})
+	}
+}
+
+func TestSendFileTransformerSpool(t *testing.T) {
+	cases := []struct {
+		profile string
+		op      transmittertest.Operation
+		spooled bool
+	}{
+		{"azure", transmittertest.OpPutBlob, true},
+		// S3 parts are retried from memory, the stream is not spooled.
+		{"default", transmittertest.OpPutPart, false},
+	}
+	for _, c := range cases {
+		t.Run(c.profile, func(t *testing.T) {
+			spoolDir := t.TempDir()
+			server, client := testServer(t, Settings{Profile: c.profile, SpoolDir: spoolDir, Transformers: []Transformer{GzipTransformer{}}})
+			server.Inject(c.op, 1, transmittertest.Fault{Delay: 200 * time.Millisecond})
+			path := writeTestFile(t, "file.log", []byte("data"))
+
+			result := make(chan error, 1)
+			go func() {
+				result <- client.SendFile(FileDetails{SourceFilename: path, DestinationFilename: "file.log.gz", PayloadType: "logs"})
+			}()
+			for server.Requests(c.op) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			during, _ := os.ReadDir(spoolDir)
+			if err := <-result; err != nil {
+				t.Fatal(err)
+			}
+			if (len(during) == 1) != c.spooled {
+				t.Fatalf("expected spooled %v, found %v", c.spooled, during)
+			}
+			if after, _ := os.ReadDir(spoolDir); len(after) != 0 {
+				t.Fatalf("expected the spool to be removed, found %v", after)
+			}
+		})
+	}
+}
@@ -0,0 +1,604 @@
+/*
+ * NTT Security Holdings Go Library for Samurai
+ * Copyright 2023 NTT Security Holdings
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package transmittertest provides an in-memory Samurai payload service for
+// testing code built on the transmitter package without network access.
+//
+// The server issues tokens on /cts/payload for both the azure and s3 profile
+// types, accepts S3 multipart part uploads, completion and abort, and
+// emulates the subset of the Azure blob API used by the transmitter. Uploaded
+// objects are kept in memory, and faults such as status codes, latency and
+// dropped connections can be injected per operation. Signed URLs can be
+// given an expiry time to exercise token refresh.
+package transmittertest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SamuraiMDR/samurai-go/pkg/credentials"
+)
+
+// Operation names a request type handled by the server.
+type Operation string
+
+const (
+	OpToken             Operation = "TOKEN"
+	OpGetSignedURL      Operation = "GET_SIGNED_URL"
+	OpCompleteMultipart Operation = "COMPLETE_MULTIPART_UPLOAD"
+	OpAbortMultipart    Operation = "ABORT_MULTIPART_UPLOAD"
+	OpPutPart           Operation = "PUT_PART"
+	OpBlobProperties    Operation = "BLOB_PROPERTIES"
+	OpPutBlob           Operation = "PUT_BLOB"
+	OpPutBlock          Operation = "PUT_BLOCK"
+	OpPutBlockList      Operation = "PUT_BLOCK_LIST"
+)
+
+// Fault describes how the server misbehaves for a matching request. Delay is
+// applied first; then the connection is dropped, or StatusCode is returned
+// with Header and Body, or the request is handled normally when neither is
+// set.
+type Fault struct {
+	Delay          time.Duration
+	StatusCode     int
+	Header         http.Header
+	Body           string
+	DropConnection bool
+}
+
+// ExpiredS3Fault is the response S3 gives for a presigned URL used after its
+// expiry time.
+var ExpiredS3Fault = Fault{
+	StatusCode: http.StatusForbidden,
+	Body:       expiredS3Body,
+}
+
+// ExpiredAzureFault is the response Azure gives for a SAS used after its
+// expiry time.
+var ExpiredAzureFault = Fault{
+	StatusCode: http.StatusForbidden,
+	Header:     http.Header{"X-Ms-Error-Code": {"AuthenticationFailed"}},
+}
+
+const expiredS3Body = `<?xml version="1.0" encoding="UTF-8"?>
+<Error><Code>AccessDenied</Code><Message>Request has expired</Message></Error>`
+
+// Options configures a Server. The zero value is usable.
+type Options struct {
+	// APIKey, Passkey and DeviceId are the credentials the server accepts.
+	// They default to "apikey", "passkey" and "device".
+	APIKey   string
+	Passkey  string
+	DeviceId string
+	// ProfileType is returned for profiles other than "azure" and "s3",
+	// which always select their own type. Defaults to "s3".
+	ProfileType string
+	// PayloadTypes lists the accepted payload types, others are answered
+	// with 415. Defaults to pcap, bouncer and logs.
+	PayloadTypes []string
+	// SignedURLTTL, when set, adds an expiry time to issued part URLs and
+	// SAS URLs and rejects them once it has passed, as S3 and Azure do.
+	SignedURLTTL time.Duration
+	// Now returns the server time used for SignedURLTTL. Defaults to
+	// time.Now.
+	Now func() time.Time
+}
+
+// Object is an upload stored by the server.
+type Object struct {
+	Name        string
+	PayloadType string
+	ProfileType string
+	Metadata    map[string]string
+	Data        []byte
+}
+
+type upload struct {
+	object Object
+	parts  map[int][]byte
+	blocks map[string][]byte
+}
+
+type fault struct {
+	op        Operation
+	remaining int
+	fault     Fault
+}
+
+// Server is a running mock payload service. Its methods are safe for
+// concurrent use.
+type Server struct {
+	*httptest.Server
+	opts Options
+
+	mu       sync.Mutex
+	seq      int
+	uploads  map[string]*upload
+	objects  map[string]Object
+	aborted  []string
+	requests map[Operation]int
+	faults   []*fault
+}
+
+// NewServer starts a server. Call Close when done.
+func NewServer(opts Options) *Server {
+	if opts.APIKey == "" {
+		opts.APIKey = "apikey"
+	}
+	if opts.Passkey == "" {
+		opts.Passkey = "passkey"
+	}
+	if opts.DeviceId == "" {
+		opts.DeviceId = "device"
+	}
+	if opts.ProfileType == "" {
+		opts.ProfileType = "s3"
+	}
+	if opts.PayloadTypes == nil {
+		opts.PayloadTypes = []string{"pcap", "bouncer", "logs"}
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	s := &Server{
+		opts:     opts,
+		uploads:  map[string]*upload{},
+		objects:  map[string]Object{},
+		requests: map[Operation]int{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Credentials returns credentials accepted by the server.
+func (s *Server) Credentials() credentials.APICredentials {
+	return credentials.APICredentials{
+		URL:       s.URL,
+		APIKey:    s.opts.APIKey,
+		Passkey:   s.opts.Passkey,
+		DeviceId:  s.opts.DeviceId,
+		AllowHTTP: true,
+	}
+}
+
+// Inject makes the next count requests of op fail with f. A count of zero or
+// less applies f to every following request of op. Faults are matched in the
+// order they were injected.
+func (s *Server) Inject(op Operation, count int, f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &fault{op: op, remaining: count, fault: f})
+}
+
+// ClearFaults removes all injected faults.
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+}
+
+// Objects returns the completed uploads sorted by name.
+func (s *Server) Objects() []Object {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	objects := make([]Object, 0, len(s.objects))
+	for _, object := range s.objects {
+		objects = append(objects, object)
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+	return objects
+}
+
+// Object returns the completed upload with the given S3 key or blob id.
+func (s *Server) Object(name string) (Object, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	object, ok := s.objects[name]
+	return object, ok
+}
+
+// Aborted returns the keys of aborted multipart uploads.
+func (s *Server) Aborted() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.aborted...)
+}
+
+// Pending returns the keys of multipart uploads that were started but
+// neither completed nor aborted.
+func (s *Server) Pending() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for key, u := range s.uploads {
+		if u.object.ProfileType == "s3" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Requests returns how many requests of op the server has received,
+// including those answered with an injected fault.
+func (s *Server) Requests(op Operation) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[op]
+}
+
+// takeFault counts the request and returns the fault to apply, if any.
+func (s *Server) takeFault(op Operation) *Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests[op]++
+	for i, f := range s.faults {
+		if f.op != op {
+			continue
+		}
+		if f.remaining > 0 {
+			f.remaining--
+			if f.remaining == 0 {
+				s.faults = append(s.faults[:i], s.faults[i+1:]...)
+			}
+		}
+		result := f.fault
+		return &result
+	}
+	return nil
+}
+
+// applyFault returns true when the request has been answered by the fault.
+func applyFault(w http.ResponseWriter, f *Fault) bool {
+	if f == nil {
+		return false
+	}
+	if f.Delay > 0 {
+		time.Sleep(f.Delay)
+	}
+	if f.DropConnection {
+		if hijacker, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hijacker.Hijack(); err == nil {
+				conn.Close()
+				return true
+			}
+		}
+		panic(http.ErrAbortHandler)
+	}
+	if f.StatusCode != 0 {
+		for key, values := range f.Header {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(f.StatusCode)
+		io.WriteString(w, f.Body)
+		return true
+	}
+	return false
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/cts/payload" && r.Method == http.MethodPost:
+		s.servePayload(w, r)
+	case strings.HasPrefix(r.URL.Path, "/s3/") && r.Method == http.MethodPut:
+		s.servePart(w, r)
+	case strings.HasPrefix(r.URL.Path, "/blob/"):
+		s.serveBlob(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type payloadRequest struct {
+	EventType   string            `json:"event_type"`
+	Payload     string            `json:"payload"`
+	Profile     string            `json:"profile"`
+	Suffix      string            `json:"suffix"`
+	Filename    string            `json:"filename"`
+	CustomKey   string            `json:"customKey"`
+	CustomValue string            `json:"customValue"`
+	Metadata    map[string]string `json:"metadata"`
+	Key         string            `json:"key"`
+	UploadId    string            `json:"upload_id"`
+	Part        int               `json:"part"`
+	Parts       []struct {
+		ETag       string `json:"ETag"`
+		PartNumber int    `json:"PartNumber"`
+	} `json:"parts"`
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) servePayload(w http.ResponseWriter, r *http.Request) {
+	var req payloadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	op := OpToken
+	if req.EventType != "" {
+		op = Operation(req.EventType)
+	}
+	if applyFault(w, s.takeFault(op)) {
+		return
+	}
+	id := r.Header.Get("device_id")
+	if id == "" {
+		id = r.Header.Get("integration_id")
+	}
+	if r.Header.Get("x-api-key") != s.opts.APIKey || r.Header.Get("passkey") != s.opts.Passkey || id != s.opts.DeviceId {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch op {
+	case OpToken:
+		s.issueToken(w, r, req)
+	case OpGetSignedURL:
+		if _, ok := s.uploads[req.Key]; !ok || req.UploadId != req.Key {
+			http.Error(w, "no such upload", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, map[string]string{"signed_url": fmt.Sprintf("%s/s3/%s/%d?%sX-Amz-Signature=mock", s.URL, req.Key, req.Part, s.s3Expiry())})
+	case OpCompleteMultipart:
+		u, ok := s.uploads[req.Key]
+		if !ok {
+			http.Error(w, "no such upload", http.StatusNotFound)
+			return
+		}
+		var data []byte
+		for i, part := range req.Parts {
+			chunk, stored := u.parts[part.PartNumber]
+			if part.PartNumber != i+1 || !stored || part.ETag != etag(part.PartNumber) {
+				http.Error(w, fmt.Sprintf("invalid part %d", part.PartNumber), http.StatusBadRequest)
+				return
+			}
+			data = append(data, chunk...)
+		}
+		u.object.Data = data
+		s.objects[req.Key] = u.object
+		delete(s.uploads, req.Key)
+		writeJSON(w, map[string]string{"Message": "Multipart upload completed"})
+	case OpAbortMultipart:
+		if _, ok := s.uploads[req.Key]; !ok {
+			http.Error(w, "no such upload", http.StatusNotFound)
+			return
+		}
+		delete(s.uploads, req.Key)
+		s.aborted = append(s.aborted, req.Key)
+		writeJSON(w, map[string]string{"Message": "Multipart upload aborted"})
+	default:
+		http.Error(w, "unknown event_type", http.StatusBadRequest)
+	}
+}
+
+func (s *Server) issueToken(w http.ResponseWriter, r *http.Request, req payloadRequest) {
+	known := false
+	for _, payload := range s.opts.PayloadTypes {
+		known = known || payload == req.Payload
+	}
+	if !known {
+		http.Error(w, "unsupported payload", http.StatusUnsupportedMediaType)
+		return
+	}
+	profileType := s.opts.ProfileType
+	if req.Profile == "azure" || req.Profile == "s3" {
+		profileType = req.Profile
+	}
+
+	s.seq++
+	name := fmt.Sprintf("%s/%d.%s", req.Payload, s.seq, req.Suffix)
+	if req.Filename != "" {
+		name = req.Payload + "/" + req.Filename
+	}
+	metadata := map[string]string{}
+	for key, value := range req.Metadata {
+		metadata[key] = value
+	}
+	if req.CustomKey != "" {
+		metadata[req.CustomKey] = req.CustomValue
+	}
+	s.uploads[name] = &upload{
+		object: Object{Name: name, PayloadType: req.Payload, ProfileType: profileType, Metadata: metadata},
+		parts:  map[int][]byte{},
+		blocks: map[string][]byte{},
+	}
+
+	if profileType == "azure" {
+		writeJSON(w, map[string]string{
+			"profile_type": "azure",
+			"sas_url":      fmt.Sprintf("%s/blob/%s?sv=2022-11-02&sr=b&sp=cw&%ssig=mock", s.URL, name, s.azureExpiry()),
+			"blob_id":      name,
+		})
+		return
+	}
+	writeJSON(w, map[string]string{"profile_type": "s3", "key": name, "upload_id": name})
+}
+
+// s3Expiry returns the presigned URL expiry parameters, if any.
+func (s *Server) s3Expiry() string {
+	if s.opts.SignedURLTTL <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("X-Amz-Date=%s&X-Amz-Expires=%d&", s.opts.Now().UTC().Format("20060102T150405Z"), int(s.opts.SignedURLTTL.Seconds()))
+}
+
+// azureExpiry returns the SAS expiry parameter, if any.
+func (s *Server) azureExpiry() string {
+	if s.opts.SignedURLTTL <= 0 {
+		return ""
+	}
+	return "se=" + s.opts.Now().Add(s.opts.SignedURLTTL).UTC().Format(time.RFC3339) + "&"
+}
+
+// expired reports whether the expiry parameters of a storage request have
+// passed.
+func (s *Server) expired(r *http.Request) bool {
+	query := r.URL.Query()
+	if se := query.Get("se"); se != "" {
+		expiry, err := time.Parse(time.RFC3339, se)
+		return err != nil || !s.opts.Now().Before(expiry)
+	}
+	if date := query.Get("X-Amz-Date"); date != "" {
+		signed, err := time.Parse("20060102T150405Z", date)
+		var seconds int
+		if _, scanErr := fmt.Sscanf(query.Get("X-Amz-Expires"), "%d", &seconds); err != nil || scanErr != nil {
+			return true
+		}
+		return !s.opts.Now().Before(signed.Add(time.Duration(seconds) * time.Second))
+	}
+	return false
+}
+
+func etag(part int) string {
+	return fmt.Sprintf("\"etag-%d\"", part)
+}
+
+func (s *Server) servePart(w http.ResponseWriter, r *http.Request) {
+	if applyFault(w, s.takeFault(OpPutPart)) {
+		return
+	}
+	if s.expired(r) {
+		applyFault(w, &ExpiredS3Fault)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/s3/")
+	slash := strings.LastIndex(path, "/")
+	var part int
+	if slash < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	if _, err := fmt.Sscanf(path[slash+1:], "%d", &part); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.uploads[path[:slash]]
+	if !ok {
+		http.Error(w, "NoSuchUpload", http.StatusNotFound)
+		return
+	}
+	u.parts[part] = data
+	w.Header().Set("ETag", etag(part))
+}
+
+type blockList struct {
+	Latest []string `xml:"Latest"`
+}
+
+func (s *Server) serveBlob(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/blob/")
+	op := OpPutBlob
+	switch {
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		op = OpBlobProperties
+	case r.URL.Query().Get("comp") == "block":
+		op = OpPutBlock
+	case r.URL.Query().Get("comp") == "blocklist":
+		op = OpPutBlockList
+	}
+	if applyFault(w, s.takeFault(op)) {
+		return
+	}
+	if s.expired(r) {
+		applyFault(w, &ExpiredAzureFault)
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if op == OpBlobProperties {
+		object, ok := s.objects[name]
+		if !ok {
+			w.Header().Set("x-ms-error-code", "BlobNotFound")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(object.Data)))
+		w.Header().Set("x-ms-blob-type", "BlockBlob")
+		return
+	}
+
+	u, ok := s.uploads[name]
+	if !ok {
+		w.Header().Set("x-ms-error-code", "AuthenticationFailed")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch op {
+	case OpPutBlock:
+		u.blocks[r.URL.Query().Get("blockid")] = data
+	case OpPutBlockList:
+		var list blockList
+		if err := xml.Unmarshal(data, &list); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var blob []byte
+		for _, id := range list.Latest {
+			block, ok := u.blocks[id]
+			if !ok {
+				w.Header().Set("x-ms-error-code", "InvalidBlockList")
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			blob = append(blob, block...)
+		}
+		u.object.Data = blob
+		s.objects[name] = u.object
+		delete(s.uploads, name)
+	default:
+		u.object.Data = data
+		s.objects[name] = u.object
+		delete(s.uploads, name)
+	}
+	w.Header().Set("ETag", "\"0x1\"")
+	w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+	if md5 := r.Header.Get("Content-MD5"); md5 != "" {
+		if _, err := base64.StdEncoding.DecodeString(md5); err == nil {
+			w.Header().Set("Content-MD5", md5)
+		}
+	}
+	w.WriteHeader(http.StatusCreated)
+}
@@ -0,0 +1,107 @@
+package transmittertest_test
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/SamuraiMDR/samurai-go/pkg/transmitter"
+	"github.com/SamuraiMDR/samurai-go/pkg/transmitter/transmittertest"
+)
+
+func writeFile(t *testing.T, name string, data []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestUploadRoundTrip(t *testing.T) {
+	for _, profile := range []string{"s3", "azure"} {
+		t.Run(profile, func(t *testing.T) {
+			server := transmittertest.NewServer(transmittertest.Options{})
+			defer server.Close()
+
+			client, err := transmitter.NewClient(transmitter.Settings{Profile: profile}, server.Credentials())
+			if err != nil {
+				t.Fatal(err)
+			}
+			data := bytes.Repeat([]byte("packet"), 1000)
+			err = client.SendFile(transmitter.FileDetails{
+				SourceFilename:      writeFile(t, "capture.pcap", data),
+				DestinationFilename: "capture.pcap",
+				PayloadType:         "pcap",
+				Metadata:            map[string]string{"site": "oslo"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			object, ok := server.Object("pcap/capture.pcap")
+			if !ok {
+				t.Fatalf("object not stored, have %+v", server.Objects())
+			}
+			if !bytes.Equal(object.Data, data) || object.ProfileType != profile || object.Metadata["site"] != "oslo" {
+				t.Fatalf("unexpected object: %s %v %d bytes", object.ProfileType, object.Metadata, len(object.Data))
+			}
+		})
+	}
+}
+
+func TestUnknownPayloadAndCredentials(t *testing.T) {
+	server := transmittertest.NewServer(transmittertest.Options{})
+	defer server.Close()
+	path := writeFile(t, "file.json", []byte("{}"))
+
+	client, err := transmitter.NewClient(transmitter.Settings{}, server.Credentials())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SendFile(transmitter.FileDetails{SourceFilename: path, PayloadType: "unknown"}); err != transmitter.ErrUnknownPayload {
+		t.Fatalf("expected ErrUnknownPayload, got %v", err)
+	}
+
+	creds := server.Credentials()
+	creds.Passkey = "wrong"
+	client, err = transmitter.NewClient(transmitter.Settings{}, creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.SendFile(transmitter.FileDetails{SourceFilename: path, PayloadType: "bouncer"})
+	var apiErr *transmitter.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %v", err)
+	}
+}
+
+func TestInjectedFaults(t *testing.T) {
+	server := transmittertest.NewServer(transmittertest.Options{})
+	defer server.Close()
+	client, err := transmitter.NewClient(transmitter.Settings{RetryBackoff: time.Millisecond}, server.Credentials())
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeFile(t, "capture.pcap", []byte("data"))
+
+	// A single failing part is retried.
+	server.Inject(transmittertest.OpPutPart, 1, transmittertest.Fault{StatusCode: http.StatusServiceUnavailable})
+	if err := client.SendFile(transmitter.FileDetails{SourceFilename: path, PayloadType: "pcap"}); err != nil {
+		t.Fatal(err)
+	}
+	if server.Requests(transmittertest.OpPutPart) != 2 {
+		t.Fatalf("expected a retry, got %d part requests", server.Requests(transmittertest.OpPutPart))
+	}
+
+	// A part that never succeeds aborts the upload.
+	server.Inject(transmittertest.OpPutPart, 0, transmittertest.Fault{DropConnection: true})
+	if err := client.SendFile(transmitter.FileDetails{SourceFilename: path, PayloadType: "pcap"}); err == nil {
+		t.Fatal("expected error")
+	}
+	if len(server.Aborted()) != 1 || len(server.Pending()) != 0 {
+		t.Fatalf("expected upload to be aborted, aborted %v pending %v", server.Aborted(), server.Pending())
+	}
+}
@@ -0,0 +1,183 @@
+/*
+ * NTT Security Holdings Go Library for Samurai
+ * Copyright 2023 NTT Security Holdings
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package transmittertest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrDropped is returned by FaultTransport for a dropped connection.
+var ErrDropped = errors.New("transmittertest: connection dropped")
+
+// TransportFault describes what FaultTransport does with one request. Delay
+// is applied first. Drop fails the request without sending it, DropResponse
+// sends it but fails before the response is returned, StatusCode answers it
+// with a synthesized response and TruncateBody sends it but cuts the response
+// body after that many bytes. The zero value passes the request through
+// unchanged.
+type TransportFault struct {
+	Delay        time.Duration
+	Drop         bool
+	DropResponse bool
+	StatusCode   int
+	TruncateBody int
+}
+
+// FaultTransport is an http.RoundTripper that injects faults into requests
+// matching Match, following Script for the first matching requests and then
+// applying Fault with the given Probability. It is safe for concurrent use.
+type FaultTransport struct {
+	// Base handles requests that are passed through, defaults to
+	// http.DefaultTransport.
+	Base http.RoundTripper
+	// Match selects the requests faults apply to, nil matches all.
+	Match func(*http.Request) bool
+	// Script is consumed one entry per matching request.
+	Script []TransportFault
+	// Fault is applied with Probability once Script is exhausted.
+	Fault       TransportFault
+	Probability float64
+	// Rand is the source for Probability, seeded with 1 when nil so runs are
+	// reproducible.
+	Rand *rand.Rand
+
+	mu      sync.Mutex
+	matched int
+	faults  int
+}
+
+// MatchRequest returns a Match function for requests with the given method
+// whose URL path contains pathPart. An empty method matches any method.
+func MatchRequest(method string, pathPart string) func(*http.Request) bool {
+	return func(r *http.Request) bool {
+		return (method == "" || r.Method == method) && strings.Contains(r.URL.Path, pathPart)
+	}
+}
+
+// Faults returns how many faults have been injected so far.
+func (t *FaultTransport) Faults() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.faults
+}
+
+func (t *FaultTransport) next(r *http.Request) TransportFault {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.Match != nil && !t.Match(r) {
+		return TransportFault{}
+	}
+	t.matched++
+	var f TransportFault
+	if t.matched <= len(t.Script) {
+		f = t.Script[t.matched-1]
+	} else if t.Probability > 0 {
+		if t.Rand == nil {
+			t.Rand = rand.New(rand.NewSource(1))
+		}
+		if t.Rand.Float64() < t.Probability {
+			f = t.Fault
+		}
+	}
+	if f != (TransportFault{}) {
+		t.faults++
+	}
+	return f
+}
+
+func (t *FaultTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	f := t.next(r)
+
+	if f.Delay > 0 {
+		select {
+		case <-time.After(f.Delay):
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		}
+	}
+	if f.Drop || f.StatusCode != 0 {
+		if r.Body != nil {
+			r.Body.Close()
+		}
+	}
+	if f.Drop {
+		return nil, ErrDropped
+	}
+	if f.StatusCode != 0 {
+		body := fmt.Sprintf("injected status %d", f.StatusCode)
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", f.StatusCode, http.StatusText(f.StatusCode)),
+			StatusCode:    f.StatusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": {"text/plain"}},
+			Body:          io.NopCloser(strings.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       r,
+		}, nil
+	}
+
+	response, err := base.RoundTrip(r)
+	if err != nil {
+		return response, err
+	}
+	if f.DropResponse {
+		io.Copy(io.Discard, response.Body)
+		response.Body.Close()
+		return nil, ErrDropped
+	}
+	if f.TruncateBody == 0 {
+		return response, nil
+	}
+	response.Body = &truncatedBody{body: response.Body, remaining: f.TruncateBody}
+	return response, nil
+}
+
+// truncatedBody ends with io.ErrUnexpectedEOF after remaining bytes, like a
+// connection closed in the middle of a response.
+type truncatedBody struct {
+	body      io.ReadCloser
+	remaining int
+}
+
+func (b *truncatedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if len(p) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.body.Read(p)
+	b.remaining -= n
+	return n, err
+}
+
+func (b *truncatedBody) Close() error {
+	return b.body.Close()
+}
@@ -0,0 +1,91 @@
+package transmittertest_test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/SamuraiMDR/samurai-go/pkg/transmitter/transmittertest"
+)
+
+func TestFaultTransportScript(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "0123456789")
+	}))
+	defer server.Close()
+
+	transport := &transmittertest.FaultTransport{
+		Match: transmittertest.MatchRequest(http.MethodGet, "/faulty"),
+		Script: []transmittertest.TransportFault{
+			{Drop: true},
+			{StatusCode: http.StatusTooManyRequests},
+			{TruncateBody: 4},
+			{},
+		},
+	}
+	client := &http.Client{Transport: transport}
+
+	if _, err := client.Get(server.URL + "/faulty"); !errors.Is(err, transmittertest.ErrDropped) {
+		t.Fatalf("expected dropped connection, got %v", err)
+	}
+	response, err := client.Get(server.URL + "/faulty")
+	if err != nil || response.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %v %v", response, err)
+	}
+	response.Body.Close()
+
+	// Requests that do not match are never faulted.
+	response, err = client.Get(server.URL + "/other")
+	if err != nil || response.StatusCode != http.StatusOK {
+		t.Fatalf("expected pass through, got %v %v", response, err)
+	}
+	response.Body.Close()
+
+	response, err = client.Get(server.URL + "/faulty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if string(body) != "0123" || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected truncated body, got %q %v", body, err)
+	}
+
+	response, err = client.Get(server.URL + "/faulty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(response.Body)
+	response.Body.Close()
+	if string(body) != "0123456789" || transport.Faults() != 3 {
+		t.Fatalf("expected script to be exhausted, got %q after %d faults", body, transport.Faults())
+	}
+}
+
+func TestFaultTransportProbability(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	transport := &transmittertest.FaultTransport{
+		Fault:       transmittertest.TransportFault{StatusCode: http.StatusBadGateway},
+		Probability: 0.5,
+	}
+	client := &http.Client{Transport: transport}
+	failed := 0
+	for i := 0; i < 200; i++ {
+		response, err := client.Post(server.URL, "text/plain", strings.NewReader("x"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode == http.StatusBadGateway {
+			failed++
+		}
+	}
+	if failed < 60 || failed > 140 || failed != transport.Faults() {
+		t.Fatalf("expected about half the requests to fail, got %d", failed)
+	}
+}
@@ -0,0 +1,281 @@
+/*
+ * NTT Security Holdings Go Library for Samurai
+ * Copyright 2023 NTT Security Holdings
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package transmitter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/SamuraiMDR/samurai-go/pkg/generator"
+)
+
+var ErrBadMagic = errors.New("unrecognized file header")
+var ErrTruncated = errors.New("file is truncated")
+var ErrMalformedJSON = errors.New("malformed JSON")
+var ErrInvalidAlert = errors.New("invalid alert")
+
+// ContentError is returned by SendFile when a Validator rejects the content
+// of a file. Err wraps one of ErrBadMagic, ErrTruncated, ErrMalformedJSON or
+// ErrInvalidAlert for the built-in validators.
+type ContentError struct {
+	PayloadType string
+	Err         error
+}
+
+func (e *ContentError) Error() string {
+	return fmt.Sprintf("invalid %s payload: %v", e.PayloadType, e.Err)
+}
+
+func (e *ContentError) Unwrap() error {
+	return e.Err
+}
+
+// Validator checks the content of a file before a token is requested.
+type Validator interface {
+	Validate(r io.ReaderAt, size int64, suffix string) error
+}
+
+// ValidatorFunc adapts a function to the Validator interface.
+type ValidatorFunc func(r io.ReaderAt, size int64, suffix string) error
+
+func (f ValidatorFunc) Validate(r io.ReaderAt, size int64, suffix string) error {
+	return f(r, size, suffix)
+}
+
+// DefaultValidators returns the built-in validators keyed by payload type.
+func DefaultValidators() map[string]Validator {
+	return map[string]Validator{
+		PayloadPcap:    PcapValidator{},
+		PayloadBouncer: AlertValidator{},
+		PayloadLogs:    JSONValidator{},
+	}
+}
+
+const (
+	pcapMagicMicro  = 0xa1b2c3d4
+	pcapMagicNano   = 0xa1b23c4d
+	pcapngBlockSHB  = 0x0a0d0d0a
+	pcapngByteOrder = 0x1a2b3c4d
+	// maxPcapRecord bounds a single record so that a corrupt length is not
+	// mistaken for a valid one.
+	maxPcapRecord = 256 * 1024 * 1024
+)
+
+// PcapValidator accepts pcap and pcapng captures. It checks the file header
+// and walks every record or block header so that a capture cut short while
+// being written is reported as ErrTruncated.
+type PcapValidator struct{}
+
+func (PcapValidator) Validate(r io.ReaderAt, size int64, suffix string) error {
+	var magic [4]byte
+	if _, err := r.ReadAt(magic[:], 0); err != nil {
+		return fmt.Errorf("reading magic: %w", ErrBadMagic)
+	}
+	switch {
+	case binary.LittleEndian.Uint32(magic[:]) == pcapngBlockSHB:
+		return validatePcapng(r, size)
+	case binary.LittleEndian.Uint32(magic[:]) == pcapMagicMicro || binary.LittleEndian.Uint32(magic[:]) == pcapMagicNano:
+		return validatePcap(r, size, binary.LittleEndian)
+	case binary.BigEndian.Uint32(magic[:]) == pcapMagicMicro || binary.BigEndian.Uint32(magic[:]) == pcapMagicNano:
+		return validatePcap(r, size, binary.BigEndian)
+	}
+	return fmt.Errorf("magic %x is neither pcap nor pcapng: %w", magic, ErrBadMagic)
+}
+
+// validatePcap walks the records through a buffered reader, skipping their
+// data, so that large captures take few reads.
+func validatePcap(r io.ReaderAt, size int64, order binary.ByteOrder) error {
+	const globalHeader, recordHeader = 24, 16
+	if size < globalHeader {
+		return fmt.Errorf("global header: %w", ErrTruncated)
+	}
+	br := bufio.NewReaderSize(io.NewSectionReader(r, globalHeader, size-globalHeader), 64*1024)
+	var hdr [recordHeader]byte
+	for offset, record := int64(globalHeader), 1; offset < size; record++ {
+		if offset+recordHeader > size {
+			return fmt.Errorf("record %d header at offset %d: %w", record, offset, ErrTruncated)
+		}
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			return err
+		}
+		length := int64(order.Uint32(hdr[8:12]))
+		if length > maxPcapRecord {
+			return fmt.Errorf("record %d at offset %d has length %d: %w", record, offset, length, ErrBadMagic)
+		}
+		offset += recordHeader + length
+		if offset > size {
+			return fmt.Errorf("record %d data: %w", record, ErrTruncated)
+		}
+		if _, err := br.Discard(int(length)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validatePcapng walks the blocks like validatePcap, checking that each
+// block ends with its length.
+func validatePcapng(r io.ReaderAt, size int64) error {
+	var order binary.ByteOrder = binary.LittleEndian
+	br := bufio.NewReaderSize(io.NewSectionReader(r, 0, size), 64*1024)
+	var hdr [12]byte
+	var trailer [4]byte
+	for offset, block := int64(0), 1; offset < size; block++ {
+		if offset+12 > size {
+			return fmt.Errorf("block %d header at offset %d: %w", block, offset, ErrTruncated)
+		}
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			return err
+		}
+		if binary.LittleEndian.Uint32(hdr[0:4]) == pcapngBlockSHB {
+			// Each section header carries its own byte order.
+			switch {
+			case binary.LittleEndian.Uint32(hdr[8:12]) == pcapngByteOrder:
+				order = binary.LittleEndian
+			case binary.BigEndian.Uint32(hdr[8:12]) == pcapngByteOrder:
+				order = binary.BigEndian
+			default:
+				return fmt.Errorf("section header at offset %d has no byte-order magic: %w", offset, ErrBadMagic)
+			}
+		}
+		length := int64(order.Uint32(hdr[4:8]))
+		if length < 12 || length%4 != 0 || length > maxPcapRecord {
+			return fmt.Errorf("block %d at offset %d has length %d: %w", block, offset, length, ErrBadMagic)
+		}
+		if offset+length > size {
+			return fmt.Errorf("block %d data: %w", block, ErrTruncated)
+		}
+		// A 12 byte block is all header, its trailing length is hdr[8:12].
+		if length > 12 {
+			if _, err := br.Discard(int(length - 16)); err != nil {
+				return err
+			}
+			if _, err := io.ReadFull(br, trailer[:]); err != nil {
+				return err
+			}
+		} else {
+			copy(trailer[:], hdr[8:12])
+		}
+		if int64(order.Uint32(trailer[:])) != length {
+			return fmt.Errorf("block %d at offset %d has mismatched trailing length: %w", block, offset, ErrBadMagic)
+		}
+		offset += length
+	}
+	return nil
+}
+
+// isNDJSON reports whether suffix names a newline-delimited JSON file.
+func isNDJSON(suffix string) bool {
+	suffix = strings.ToLower(suffix)
+	return suffix == "ndjson" || suffix == "jsonl"
+}
+
+// JSONValidator checks that .json files hold exactly one JSON value and that
+// every non-empty line of .ndjson and .jsonl files is a JSON value. Files
+// with other suffixes are accepted as is.
+type JSONValidator struct{}
+
+func (JSONValidator) Validate(r io.ReaderAt, size int64, suffix string) error {
+	switch {
+	case isNDJSON(suffix):
+		return eachJSONLine(r, size, func(line []byte) error { return nil })
+	case strings.EqualFold(suffix, "json"):
+		return singleJSONValue(r, size, new(json.RawMessage))
+	}
+	return nil
+}
+
+func singleJSONValue(r io.ReaderAt, size int64, v any) error {
+	dec := json.NewDecoder(io.NewSectionReader(r, 0, size))
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("%v: %w", err, ErrMalformedJSON)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("unexpected data after offset %d: %w", dec.InputOffset(), ErrMalformedJSON)
+	}
+	return nil
+}
+
+func eachJSONLine(r io.ReaderAt, size int64, fn func(line []byte) error) error {
+	scanner := bufio.NewScanner(io.NewSectionReader(r, 0, size))
+	scanner.Buffer(nil, maxPcapRecord)
+	for line := 1; scanner.Scan(); line++ {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		if !json.Valid(data) {
+			return fmt.Errorf("line %d: %w", line, ErrMalformedJSON)
+		}
+		if err := fn(data); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// AlertValidator checks bouncer payloads: a single AlertV1 object, a JSON
+// array of them or one per line for .ndjson and .jsonl files. Every alert
+// must pass generator.AlertV1.ValidateAlert.
+type AlertValidator struct{}
+
+func (AlertValidator) Validate(r io.ReaderAt, size int64, suffix string) error {
+	if isNDJSON(suffix) {
+		return eachJSONLine(r, size, func(line []byte) error {
+			var alert generator.AlertV1
+			if err := json.Unmarshal(line, &alert); err != nil {
+				return fmt.Errorf("%v: %w", err, ErrInvalidAlert)
+			}
+			return validateAlert(alert)
+		})
+	}
+	var raw json.RawMessage
+	if err := singleJSONValue(r, size, &raw); err != nil {
+		return err
+	}
+	var alerts []generator.AlertV1
+	if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(raw, &alerts); err != nil {
+			return fmt.Errorf("%v: %w", err, ErrInvalidAlert)
+		}
+	} else {
+		var alert generator.AlertV1
+		if err := json.Unmarshal(raw, &alert); err != nil {
+			return fmt.Errorf("%v: %w", err, ErrInvalidAlert)
+		}
+		alerts = append(alerts, alert)
+	}
+	for i, alert := range alerts {
+		if err := validateAlert(alert); err != nil {
+			return fmt.Errorf("alert %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func validateAlert(alert generator.AlertV1) error {
+	if err := alert.ValidateAlert(); err != nil {
+		return fmt.Errorf("%v: %w", err, ErrInvalidAlert)
+	}
+	return nil
+}
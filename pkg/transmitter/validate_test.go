@@ -0,0 +1,135 @@
+package transmitter
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/SamuraiMDR/samurai-go/pkg/generator"
+	"github.com/SamuraiMDR/samurai-go/pkg/transmitter/transmittertest"
+)
+
+func pcapFile(order binary.ByteOrder, records ...[]byte) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, order, []uint32{pcapMagicMicro, 0x00040002, 0, 0, 65535, 1})
+	for _, r := range records {
+		binary.Write(&buf, order, []uint32{0, 0, uint32(len(r)), uint32(len(r))})
+		buf.Write(r)
+	}
+	return buf.Bytes()
+}
+
+func pcapngBlock(order binary.ByteOrder, blockType uint32, body []byte) []byte {
+	var buf bytes.Buffer
+	length := uint32(12 + len(body))
+	binary.Write(&buf, order, []uint32{blockType, length})
+	buf.Write(body)
+	binary.Write(&buf, order, length)
+	return buf.Bytes()
+}
+
+func pcapngFile(order binary.ByteOrder) []byte {
+	var shb bytes.Buffer
+	binary.Write(&shb, order, uint32(pcapngByteOrder))
+	binary.Write(&shb, order, []uint16{1, 0})
+	binary.Write(&shb, order, int64(-1))
+	return append(pcapngBlock(order, pcapngBlockSHB, shb.Bytes()), pcapngBlock(order, 6, make([]byte, 24))...)
+}
+
+func validAlert() generator.AlertV1 {
+	alert := generator.GetBaseAlertV1()
+	alert.Action = "BLOCK"
+	alert.Name = "test"
+	alert.DevicePhysical = "sensor"
+	alert.DeviceVirtual = "sensor"
+	alert.Src = "10.0.0.1"
+	alert.Dst = "10.0.0.2"
+	alert.Type = "hids"
+	alert.Vendor = "vendor"
+	alert.Platform = "platform"
+	alert.ShortDesc = "test alert"
+	alert.LongdescMD = "test alert"
+	alert.AddTimeStampFields(time.Unix(1700000000, 0))
+	alert.SetSha()
+	return alert
+}
+
+func mustJSON(t *testing.T, v any) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestValidators(t *testing.T) {
+	pcap := pcapFile(binary.LittleEndian, []byte("packet one"), []byte("two"))
+	pcapng := pcapngFile(binary.BigEndian)
+	alert := validAlert()
+	invalid := alert
+	invalid.Action = "DROP"
+
+	cases := []struct {
+		name      string
+		validator Validator
+		suffix    string
+		data      []byte
+		wantErr   error
+	}{
+		{"pcap", PcapValidator{}, "pcap", pcap, nil},
+		{"pcap big endian", PcapValidator{}, "pcap", pcapFile(binary.BigEndian, []byte("x")), nil},
+		{"pcap header only", PcapValidator{}, "pcap", pcap[:24], nil},
+		{"pcap truncated record", PcapValidator{}, "pcap", pcap[:len(pcap)-1], ErrTruncated},
+		{"pcap truncated record header", PcapValidator{}, "pcap", pcap[:24+8], ErrTruncated},
+		{"pcap truncated global header", PcapValidator{}, "pcap", pcap[:10], ErrTruncated},
+		{"pcap bad magic", PcapValidator{}, "pcap", []byte("not a capture file"), ErrBadMagic},
+		{"pcapng", PcapValidator{}, "pcapng", pcapng, nil},
+		{"pcapng little endian", PcapValidator{}, "pcapng", pcapngFile(binary.LittleEndian), nil},
+		{"pcapng truncated", PcapValidator{}, "pcapng", pcapng[:len(pcapng)-4], ErrTruncated},
+		{"json", JSONValidator{}, "json", []byte(`{"a": [1, 2]}`), nil},
+		{"json trailing data", JSONValidator{}, "json", []byte(`{"a": 1} {"b": 2}`), ErrMalformedJSON},
+		{"json truncated", JSONValidator{}, "json", []byte(`{"a": [1, 2`), ErrMalformedJSON},
+		{"json empty", JSONValidator{}, "json", nil, ErrMalformedJSON},
+		{"ndjson", JSONValidator{}, "ndjson", []byte("{\"a\": 1}\n\n[2]\n"), nil},
+		{"ndjson bad line", JSONValidator{}, "jsonl", []byte("{\"a\": 1}\n{\"a\":\n"), ErrMalformedJSON},
+		{"plain log", JSONValidator{}, "log", []byte("not json"), nil},
+		{"alert", AlertValidator{}, "json", mustJSON(t, alert), nil},
+		{"alert array", AlertValidator{}, "json", mustJSON(t, []generator.AlertV1{alert, alert}), nil},
+		{"alert lines", AlertValidator{}, "ndjson", append(append(mustJSON(t, alert), '\n'), mustJSON(t, alert)...), nil},
+		{"invalid alert", AlertValidator{}, "json", mustJSON(t, invalid), ErrInvalidAlert},
+		{"invalid alert in array", AlertValidator{}, "json", mustJSON(t, []generator.AlertV1{alert, invalid}), ErrInvalidAlert},
+		{"alert not json", AlertValidator{}, "json", []byte("alert"), ErrMalformedJSON},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := c.validator.Validate(bytes.NewReader(c.data), int64(len(c.data)), c.suffix)
+			if !errors.Is(err, c.wantErr) || (err == nil) != (c.wantErr == nil) {
+				t.Fatalf("Validate() error = %v, want %v", err, c.wantErr)
+			}
+		})
+	}
+}
+
+func TestSendFileRejectsInvalidContent(t *testing.T) {
+	server, client := testServer(t, Settings{ValidateContent: true})
+	pcap := pcapFile(binary.LittleEndian, []byte("packet"))
+	path := writeTestFile(t, "capture.pcap", pcap[:len(pcap)-2])
+
+	_, err := client.SendFileContext(context.Background(), FileDetails{SourceFilename: path, PayloadType: PayloadPcap})
+	var contentErr *ContentError
+	if !errors.As(err, &contentErr) || contentErr.PayloadType != PayloadPcap || !errors.Is(err, ErrTruncated) {
+		t.Fatalf("expected truncated pcap ContentError, got %v", err)
+	}
+	if server.Requests(transmittertest.OpToken) != 0 {
+		t.Fatal("invalid content must be rejected before requesting a token")
+	}
+
+	path = writeTestFile(t, "capture.pcap", pcap)
+	if err := client.SendFile(FileDetails{SourceFilename: path, PayloadType: PayloadPcap}); err != nil {
+		t.Fatal(err)
+	}
+}
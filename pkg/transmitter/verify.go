@@ -0,0 +1,236 @@
+/*
+ * NTT Security Holdings Go Library for Samurai
+ * Copyright 2023 NTT Security Holdings
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package transmitter
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxClockSkew is the largest difference to the service clock that Verify
+// accepts. Signed storage URLs are rejected well before 15 minutes of skew.
+const maxClockSkew = 5 * time.Minute
+
+// verifyPayload is a payload type the service does not know. A token request
+// for it is answered with 415 naming the payload once authentication has
+// passed, so nothing is created on the service side.
+const verifyPayload = "connectivity-check"
+
+// verifyProxy returns the proxy the transport uses for u, or nil when it
+// connects directly or is not an *http.Transport.
+func verifyProxy(transport http.RoundTripper, u *url.URL) *url.URL {
+	t, ok := transport.(*http.Transport)
+	if !ok || t.Proxy == nil {
+		return nil
+	}
+	proxy, err := t.Proxy(&http.Request{URL: u})
+	if err != nil {
+		return nil
+	}
+	return proxy
+}
+
+// VerifyStep is the outcome of one check made by Verify.
+type VerifyStep struct {
+	Name     string
+	OK       bool
+	Skipped  bool
+	Reason   string
+	Duration time.Duration
+}
+
+// VerifyReport lists the checks made by Verify in the order they ran.
+type VerifyReport struct {
+	Steps     []VerifyStep
+	ClockSkew time.Duration
+}
+
+// OK reports whether every step that ran succeeded.
+func (r VerifyReport) OK() bool {
+	return r.Err() == nil
+}
+
+// Err returns the first failing step as an error, or nil.
+func (r VerifyReport) Err() error {
+	for _, step := range r.Steps {
+		if !step.OK && !step.Skipped {
+			return fmt.Errorf("%s: %s", step.Name, step.Reason)
+		}
+	}
+	return nil
+}
+
+// Verify checks that the client can reach and authenticate against the
+// payload API: credentials are retrieved and validated, the host name is
+// resolved, a connection is made through the configured transport and
+// proxy, a harmless token request is sent and the local clock is compared
+// with the service clock. Steps after a failing
+// step are skipped. The returned error is only set when ctx ends.
+func (client Client) Verify(ctx context.Context) (VerifyReport, error) {
+	var report VerifyReport
+	failed := false
+
+	run := func(name string, check func() (string, error)) {
+		step := VerifyStep{Name: name}
+		if failed {
+			step.Skipped = true
+			step.Reason = "skipped after earlier failure"
+			report.Steps = append(report.Steps, step)
+			return
+		}
+		start := time.Now()
+		reason, err := check()
+		step.Duration = time.Since(start)
+		if err != nil {
+			step.Reason = err.Error()
+			failed = true
+		} else {
+			step.OK = true
+			step.Reason = reason
+		}
+		report.Steps = append(report.Steps, step)
+	}
+
+	var api *APIClient
+	var endpoint *url.URL
+	var serviceTime time.Time
+
+	run("credentials", func() (string, error) {
+		creds, err := client.provider.Retrieve(ctx)
+		if err != nil {
+			return "", err
+		}
+		api, err = NewAPIClient(client.settings, creds)
+		if err != nil {
+			return "", err
+		}
+		endpoint, err = url.Parse(creds.URL)
+		return "credentials are complete", err
+	})
+	if api != nil {
+		defer api.Close()
+	}
+
+	// endpoint is only set, and the steps below only run, once credentials
+	// passed.
+	transport := newTransport(client.settings)
+	var proxy *url.URL
+
+	run("dns", func() (string, error) {
+		proxy = verifyProxy(transport, endpoint)
+		switch {
+		case proxy != nil:
+			return fmt.Sprintf("%s is resolved by proxy %s", endpoint.Hostname(), proxy.Redacted()), nil
+		case client.settings.Transport != nil:
+			return fmt.Sprintf("%s is resolved by the configured transport", endpoint.Hostname()), nil
+		}
+		addrs, err := net.DefaultResolver.LookupHost(ctx, endpoint.Hostname())
+		if err != nil {
+			return "", fmt.Errorf("could not resolve %s: %v", endpoint.Hostname(), err)
+		}
+		return fmt.Sprintf("%s resolves to %v", endpoint.Hostname(), addrs), nil
+	})
+
+	// Any response proves that the connection and TLS handshake, through a
+	// proxy if one is configured, succeeded.
+	run("tls", func() (string, error) {
+		request, err := http.NewRequestWithContext(ctx, http.MethodHead, endpoint.String(), nil)
+		if err != nil {
+			return "", err
+		}
+		request.Header.Set("User-Agent", UserAgent)
+		httpClient := &http.Client{Transport: transport, Timeout: apiTimeout}
+		defer httpClient.CloseIdleConnections()
+		response, err := httpClient.Do(request)
+		if err != nil {
+			return "", fmt.Errorf("could not connect to %s: %v", endpoint.Host, redactError(err))
+		}
+		response.Body.Close()
+		via := ""
+		if proxy != nil {
+			via = " via proxy " + proxy.Redacted()
+		}
+		state := response.TLS
+		if state == nil {
+			return fmt.Sprintf("connected to %s over %s%s", endpoint.Host, endpoint.Scheme, via), nil
+		}
+		if len(state.PeerCertificates) > 0 {
+			cert := state.PeerCertificates[0]
+			return fmt.Sprintf("%s%s, certificate %s valid until %s", tls.VersionName(state.Version), via, cert.Subject.CommonName, cert.NotAfter.Format(time.RFC3339)), nil
+		}
+		return tls.VersionName(state.Version) + via, nil
+	})
+
+	run("authentication", func() (string, error) {
+		request := sas{Payload: verifyPayload, Profile: client.settings.Profile, Suffix: "txt", Filename: verifyPayload}
+		status, header, body, err := api.send(ctx, request)
+		if err != nil {
+			return "", err
+		}
+		if date, dateErr := http.ParseTime(header.Get("Date")); dateErr == nil {
+			serviceTime = date
+		}
+		switch status {
+		case http.StatusUnsupportedMediaType:
+			// A proxy or gateway may answer 415 before authentication, only
+			// a rejection of the payload type proves it passed.
+			if !strings.Contains(strings.ToLower(string(body)), "payload") {
+				return "", fmt.Errorf("unexpected 415 response, authentication could not be confirmed: %q", body[:min(len(body), 200)])
+			}
+			return "accepted by the payload API", nil
+		case http.StatusOK:
+			// Unexpectedly accepted, do not leave a multipart upload behind.
+			var result sasResult
+			if err := json.Unmarshal(body, &result); err == nil && result.Type == "s3" {
+				if _, err := api.AbortMultipartUpload(ctx, result.Key, result.UploadId); err != nil {
+					log.Warnf("Could not abort multipart upload %v created by verify: %v", result.Key, err)
+				}
+			}
+			return "accepted by the payload API", nil
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return "", fmt.Errorf("rejected by the payload API, check apiKey, passkey and deviceId/integrationId (%v)", &APIError{StatusCode: status, Body: string(body)})
+		default:
+			return "", &APIError{StatusCode: status, Body: string(body)}
+		}
+	})
+
+	run("clock", func() (string, error) {
+		if serviceTime.IsZero() {
+			return "service did not send a Date header", nil
+		}
+		report.ClockSkew = time.Since(serviceTime).Round(time.Second)
+		skew := report.ClockSkew
+		if skew < 0 {
+			skew = -skew
+		}
+		if skew > maxClockSkew {
+			return "", fmt.Errorf("local clock differs from the service by %v, signed uploads will fail", report.ClockSkew)
+		}
+		return fmt.Sprintf("local clock differs from the service by %v", report.ClockSkew), nil
+	})
+
+	return report, ctx.Err()
+}
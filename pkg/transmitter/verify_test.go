@@ -0,0 +1,152 @@
+package transmitter
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SamuraiMDR/samurai-go/pkg/credentials"
+)
+
+func verifyServer(t *testing.T, status int, date time.Time) *httptest.Server {
+	return verifyServerBody(t, status, "unsupported payload", date)
+}
+
+func verifyServerBody(t *testing.T, status int, body string, date time.Time) *httptest.Server {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", date.UTC().Format(http.TimeFormat))
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestVerify(t *testing.T) {
+	cases := []struct {
+		name     string
+		settings Settings
+		status   int
+		date     time.Time
+		failStep string
+	}{
+		{"ok", Settings{AllowInsecureTLS: true}, http.StatusUnsupportedMediaType, time.Now(), ""},
+		{"untrusted certificate", Settings{}, http.StatusUnsupportedMediaType, time.Now(), "tls"},
+		{"bad credentials", Settings{AllowInsecureTLS: true}, http.StatusForbidden, time.Now(), "authentication"},
+		{"clock skew", Settings{AllowInsecureTLS: true}, http.StatusUnsupportedMediaType, time.Now().Add(-time.Hour), "clock"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			server := verifyServer(t, c.status, c.date)
+			client, err := NewClient(c.settings, credentials.APICredentials{URL: server.URL, APIKey: "key", Passkey: "pass", DeviceId: "device"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			report, err := client.Verify(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.failStep == "" {
+				if !report.OK() {
+					t.Fatalf("expected report to pass: %+v", report)
+				}
+				return
+			}
+			if report.OK() || !strings.HasPrefix(report.Err().Error(), c.failStep+":") {
+				t.Fatalf("expected %s to fail, got %v: %+v", c.failStep, report.Err(), report)
+			}
+		})
+	}
+}
+
+// providerFunc adapts a function to a credentials.Provider.
+type providerFunc func(ctx context.Context) (credentials.APICredentials, error)
+
+func (f providerFunc) Retrieve(ctx context.Context) (credentials.APICredentials, error) {
+	return f(ctx)
+}
+
+func TestVerifyCredentialsFailure(t *testing.T) {
+	cases := []struct {
+		name     string
+		provider credentials.Provider
+	}{
+		{"provider error", providerFunc(func(ctx context.Context) (credentials.APICredentials, error) {
+			return credentials.APICredentials{}, credentials.ErrNoCredentials
+		})},
+		{"invalid credentials", providerFunc(func(ctx context.Context) (credentials.APICredentials, error) {
+			return credentials.APICredentials{URL: "http://host.invalid", APIKey: "key", Passkey: "pass", DeviceId: "device"}, nil
+		})},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, err := NewClient(Settings{}, c.provider)
+			if err != nil {
+				t.Fatal(err)
+			}
+			report, err := client.Verify(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(report.Steps) != 5 || report.Steps[0].OK || !strings.HasPrefix(report.Err().Error(), "credentials:") {
+				t.Fatalf("expected credentials to fail: %+v", report.Steps)
+			}
+			for _, step := range report.Steps[1:] {
+				if !step.Skipped {
+					t.Fatalf("expected %s to be skipped: %+v", step.Name, report.Steps)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifySkipsAfterFailure(t *testing.T) {
+	client, err := NewClient(Settings{}, credentials.APICredentials{URL: "https://host.invalid", APIKey: "key", Passkey: "pass", DeviceId: "device"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, _ := client.Verify(context.Background())
+	if len(report.Steps) != 5 || report.Steps[1].OK || !report.Steps[2].Skipped || !report.Steps[4].Skipped {
+		t.Fatalf("expected dns failure and later steps skipped: %+v", report.Steps)
+	}
+}
+
+func TestVerifyUnconfirmed415(t *testing.T) {
+	// A gateway answering 415 before authentication.
+	server := verifyServerBody(t, http.StatusUnsupportedMediaType, "content type not allowed", time.Now())
+	client, err := NewClient(Settings{AllowInsecureTLS: true}, credentials.APICredentials{URL: server.URL, APIKey: "key", Passkey: "pass", DeviceId: "device"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, _ := client.Verify(context.Background())
+	if report.OK() || !strings.HasPrefix(report.Err().Error(), "authentication:") {
+		t.Fatalf("expected authentication to fail, got %+v", report)
+	}
+}
+
+func TestVerifyUsesTransport(t *testing.T) {
+	server := verifyServer(t, http.StatusUnsupportedMediaType, time.Now())
+	// The host name only resolves through the transport, as behind a proxy.
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+		},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	client, err := NewClient(Settings{Transport: transport}, credentials.APICredentials{URL: "https://payload.invalid", APIKey: "key", Passkey: "pass", DeviceId: "device"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := client.Verify(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("expected report to pass: %+v", report)
+	}
+}